@@ -0,0 +1,20 @@
+package entities
+
+const (
+	BulkItemCreated = "created"
+	BulkItemFailed  = "failed"
+	BulkItemSkipped = "skipped"
+)
+
+type BulkItemResult struct {
+	Index  int           `json:"index"`
+	Id     *uint         `json:"id,omitempty"`
+	Status string        `json:"status"`
+	Errors []*FieldError `json:"errors,omitempty"`
+}
+
+type BulkResult struct {
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Results []*BulkItemResult `json:"results"`
+}
@@ -0,0 +1,12 @@
+package entities
+
+import "encoding/json"
+
+// ExpandedVisit is a visit whose user and location hold either the id or the stored entity
+type ExpandedVisit struct {
+	Id        *uint           `json:"id"`
+	Location  json.RawMessage `json:"location"`
+	User      json.RawMessage `json:"user"`
+	VisitedAt *int            `json:"visited_at"`
+	Mark      *int            `json:"mark"`
+}
@@ -1,5 +1,7 @@
 package entities
 
+import "math"
+
 type Location struct {
 	Distance *uint   `json:"distance"`
 	City     *string `json:"city"`
@@ -11,3 +13,11 @@ type Location struct {
 type LocationCollection struct {
 	Locations []*Location `json:"locations"`
 }
+
+var LocationRules = EntityRules{
+	{Name: "id", Type: UintField, Key: true, Required: true},
+	{Name: "place", Type: StringField, Required: true},
+	{Name: "country", Type: StringField, Required: true, MaxLength: 50},
+	{Name: "city", Type: StringField, Required: true, MaxLength: 50},
+	{Name: "distance", Type: UintField, Required: true, Range: &Range{Min: 1, Max: math.MaxUint32}},
+}
@@ -0,0 +1,13 @@
+package entities
+
+type DemographicGroup struct {
+	Group string  `json:"group"`
+	Count int     `json:"count"`
+	Avg   float64 `json:"avg"`
+}
+
+type LocationDemographics struct {
+	Count  int                 `json:"count"`
+	Gender []*DemographicGroup `json:"gender"`
+	Age    []*DemographicGroup `json:"age"`
+}
@@ -0,0 +1,52 @@
+package entities
+
+type LocationRank struct {
+	Id      uint    `json:"id"`
+	Place   string  `json:"place"`
+	Country string  `json:"country"`
+	City    string  `json:"city"`
+	Visits  int     `json:"visits"`
+	Avg     float64 `json:"avg"`
+}
+
+type LocationRankCollection struct {
+	Locations []*LocationRank `json:"locations"`
+	RankBy    string          `json:"-"`
+}
+
+func (locationRankCollection *LocationRankCollection) Len() int {
+	return len(locationRankCollection.Locations)
+}
+
+func (locationRankCollection *LocationRankCollection) Swap(i, j int) {
+	locationRankCollection.Locations[i], locationRankCollection.Locations[j] = locationRankCollection.Locations[j], locationRankCollection.Locations[i]
+}
+
+// Less puts the best locations first: by average mark or by number of visits, the other one breaks ties
+func (locationRankCollection *LocationRankCollection) Less(i, j int) bool {
+
+	first, second := locationRankCollection.Locations[i], locationRankCollection.Locations[j]
+
+	if locationRankCollection.RankBy == "visits" {
+
+		if first.Visits != second.Visits {
+			return first.Visits > second.Visits
+		}
+
+		if first.Avg != second.Avg {
+			return first.Avg > second.Avg
+		}
+
+	} else {
+
+		if first.Avg != second.Avg {
+			return first.Avg > second.Avg
+		}
+
+		if first.Visits != second.Visits {
+			return first.Visits > second.Visits
+		}
+	}
+
+	return first.Id < second.Id
+}
@@ -0,0 +1,13 @@
+package entities
+
+type LocationStats struct {
+	Count        int     `json:"count"`
+	Visitors     int     `json:"visitors"`
+	Min          *int    `json:"min"`
+	Max          *int    `json:"max"`
+	Mean         float64 `json:"mean"`
+	Median       float64 `json:"median"`
+	Histogram    []int   `json:"histogram"`
+	FirstVisitAt *int    `json:"first_visit_at"`
+	LastVisitAt  *int    `json:"last_visit_at"`
+}
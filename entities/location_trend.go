@@ -0,0 +1,12 @@
+package entities
+
+type TrendBucket struct {
+	Bucket string  `json:"bucket"`
+	From   int64   `json:"from"`
+	Count  int     `json:"count"`
+	Avg    float64 `json:"avg"`
+}
+
+type LocationTrend struct {
+	Trend []*TrendBucket `json:"trend"`
+}
@@ -0,0 +1,7 @@
+package entities
+
+// LocationVisit is a visit of a location together with its visitor
+type LocationVisit struct {
+	Visit *Visit
+	User  *User
+}
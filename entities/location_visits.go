@@ -0,0 +1,106 @@
+package entities
+
+import "sort"
+
+type LocationVisitItem struct {
+	Visit     uint `json:"visit"`
+	User      uint `json:"user"`
+	Mark      int  `json:"mark"`
+	VisitedAt int  `json:"visited_at"`
+}
+
+type LocationVisitItemCollection struct {
+	Visits     []*LocationVisitItem `json:"visits"`
+	Next       string               `json:"next,omitempty"`
+	sortBy     string
+	descending bool
+}
+
+func (locationVisitItemCollection *LocationVisitItemCollection) Len() int {
+	return len(locationVisitItemCollection.Visits)
+}
+
+func (locationVisitItemCollection *LocationVisitItemCollection) Swap(i, j int) {
+	locationVisitItemCollection.Visits[i], locationVisitItemCollection.Visits[j] = locationVisitItemCollection.Visits[j], locationVisitItemCollection.Visits[i]
+}
+
+func (locationVisitItemCollection *LocationVisitItemCollection) Less(i, j int) bool {
+
+	first, second := locationVisitItemCollection.Visits[i], locationVisitItemCollection.Visits[j]
+
+	if locationVisitItemCollection.descending {
+		first, second = second, first
+	}
+
+	switch locationVisitItemCollection.sortBy {
+	case "mark":
+		if first.Mark != second.Mark {
+			return first.Mark < second.Mark
+		}
+	case "user":
+		if first.User != second.User {
+			return first.User < second.User
+		}
+	}
+
+	if first.VisitedAt != second.VisitedAt {
+		return first.VisitedAt < second.VisitedAt
+	}
+
+	return first.Visit < second.Visit
+}
+
+// SortBy orders the visits by mark, user or visited_at, ties are ordered by visited_at
+func (locationVisitItemCollection *LocationVisitItemCollection) SortBy(sortBy string, descending bool) {
+
+	locationVisitItemCollection.sortBy = sortBy
+	locationVisitItemCollection.descending = descending
+
+	sort.Sort(locationVisitItemCollection)
+}
+
+type Visitor struct {
+	User      uint   `json:"user"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Visits    int    `json:"visits"`
+}
+
+type VisitorCollection struct {
+	Visitors   []*Visitor `json:"visitors"`
+	Next       string     `json:"next,omitempty"`
+	sortBy     string
+	descending bool
+}
+
+func (visitorCollection *VisitorCollection) Len() int {
+	return len(visitorCollection.Visitors)
+}
+
+func (visitorCollection *VisitorCollection) Swap(i, j int) {
+	visitorCollection.Visitors[i], visitorCollection.Visitors[j] = visitorCollection.Visitors[j], visitorCollection.Visitors[i]
+}
+
+func (visitorCollection *VisitorCollection) Less(i, j int) bool {
+
+	first, second := visitorCollection.Visitors[i], visitorCollection.Visitors[j]
+
+	if visitorCollection.descending {
+		first, second = second, first
+	}
+
+	if visitorCollection.sortBy == "visits" && first.Visits != second.Visits {
+		return first.Visits < second.Visits
+	}
+
+	return first.User < second.User
+}
+
+// SortBy orders the visitors by visits or user, ties are ordered by user
+func (visitorCollection *VisitorCollection) SortBy(sortBy string, descending bool) {
+
+	visitorCollection.sortBy = sortBy
+	visitorCollection.descending = descending
+
+	sort.Sort(visitorCollection)
+}
@@ -0,0 +1,21 @@
+package entities
+
+// Region aggregates the visits of all locations of a country or a city
+type Region struct {
+	Name      string  `json:"name"`
+	Locations int     `json:"locations"`
+	Visits    int     `json:"visits"`
+	Avg       float64 `json:"avg"`
+}
+
+type CountryCollection struct {
+	Countries []*Region `json:"countries"`
+}
+
+type CityCollection struct {
+	Cities []*Region `json:"cities"`
+}
+
+type RegionAvgMark struct {
+	Avg float64 `json:"avg"`
+}
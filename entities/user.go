@@ -12,3 +12,12 @@ type User struct {
 type UserCollection struct {
 	Users []*User `json:"users"`
 }
+
+var UserRules = EntityRules{
+	{Name: "id", Type: UintField, Key: true, Required: true},
+	{Name: "email", Type: StringField, Required: true, MaxLength: 100, Email: true},
+	{Name: "first_name", Type: StringField, Required: true, MaxLength: 50},
+	{Name: "last_name", Type: StringField, Required: true, MaxLength: 50},
+	{Name: "gender", Type: StringField, Required: true, Enum: []string{"m", "f"}},
+	{Name: "birth_date", Type: IntField, Required: true},
+}
@@ -0,0 +1,21 @@
+package entities
+
+type UserAvgMark struct {
+	Avg float64 `json:"avg"`
+}
+
+type UserStats struct {
+	Count         int     `json:"count"`
+	Avg           float64 `json:"avg"`
+	Locations     int     `json:"locations"`
+	Countries     int     `json:"countries"`
+	TotalDistance uint    `json:"total_distance"`
+}
+
+// UserComputed holds the computed attributes of a user, only the ones requested with include= are returned
+type UserComputed struct {
+	Age          *int     `json:"age"`
+	VisitCount   *int     `json:"visit_count"`
+	AvgMarkGiven *float64 `json:"avg_mark_given"`
+	LastVisitAt  *int     `json:"last_visit_at"`
+}
@@ -0,0 +1,163 @@
+package entities
+
+import (
+	"fmt"
+	"github.com/asaskevich/govalidator"
+	"github.com/json-iterator/go"
+	"math"
+	"strconv"
+)
+
+type FieldType int
+
+const (
+	StringField FieldType = iota
+	IntField
+	UintField
+)
+
+type ValidationMode int
+
+const (
+	// ValidateCreate requires every required field including the key
+	ValidateCreate ValidationMode = iota
+	// ValidateReplace requires every required field, the key is taken from the path
+	ValidateReplace
+	// ValidatePatch checks only the fields which are present
+	ValidatePatch
+)
+
+type Range struct {
+	Min float64
+	Max float64
+}
+
+type FieldRule struct {
+	Name      string
+	Type      FieldType
+	Key       bool
+	Required  bool
+	MaxLength int
+	Enum      []string
+	Range     *Range
+	Email     bool
+}
+
+type EntityRules []*FieldRule
+
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+type ValidationErrors struct {
+	Errors []*FieldError `json:"errors"`
+}
+
+func (entityRules EntityRules) Validate(values map[string]interface{}, mode ValidationMode) []*FieldError {
+
+	var fieldErrors []*FieldError
+
+	for _, fieldRule := range entityRules {
+
+		value, ok := values[fieldRule.Name]
+
+		if !ok {
+
+			if fieldRule.isRequired(mode) {
+				fieldErrors = append(fieldErrors, &FieldError{Field: fieldRule.Name, Reason: "is required"})
+			}
+
+			continue
+		}
+
+		if reason := fieldRule.check(value); reason != "" {
+			fieldErrors = append(fieldErrors, &FieldError{Field: fieldRule.Name, Reason: reason})
+		}
+	}
+
+	return fieldErrors
+}
+
+func (fieldRule *FieldRule) isRequired(mode ValidationMode) bool {
+
+	switch mode {
+	case ValidateCreate:
+		return fieldRule.Required
+	case ValidateReplace:
+		return fieldRule.Required && !fieldRule.Key
+	default:
+		return false
+	}
+}
+
+func (fieldRule *FieldRule) check(value interface{}) string {
+
+	if value == nil {
+		return "must not be null"
+	}
+
+	switch fieldRule.Type {
+	case StringField:
+
+		stringValue, typeOk := value.(string)
+
+		if !typeOk {
+			return "must be a string"
+		}
+
+		if fieldRule.MaxLength > 0 && len(stringValue) > fieldRule.MaxLength {
+			return fmt.Sprintf("must be at most %d characters long", fieldRule.MaxLength)
+		}
+
+		if fieldRule.Email && !govalidator.IsEmail(stringValue) {
+			return "must be a valid email"
+		}
+
+		if len(fieldRule.Enum) != 0 && !isOneOf(stringValue, fieldRule.Enum) {
+			return fmt.Sprintf("must be one of %v", fieldRule.Enum)
+		}
+
+	case IntField, UintField:
+
+		numberValue, typeOk := value.(float64)
+
+		if !typeOk || numberValue != math.Trunc(numberValue) {
+			return "must be an integer"
+		}
+
+		if fieldRule.Type == UintField && numberValue < 0 {
+			return "must not be negative"
+		}
+
+		if fieldRule.Range != nil && (numberValue < fieldRule.Range.Min || numberValue > fieldRule.Range.Max) {
+			return fmt.Sprintf("must be between %s and %s", strconv.FormatFloat(fieldRule.Range.Min, 'f', -1, 64), strconv.FormatFloat(fieldRule.Range.Max, 'f', -1, 64))
+		}
+	}
+
+	return ""
+}
+
+func isOneOf(value string, enum []string) bool {
+
+	for _, enumValue := range enum {
+
+		if value == enumValue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply copies validated values onto entity, fields which are absent from values stay untouched
+func Apply(values map[string]interface{}, entity interface{}) error {
+
+	valuesBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(values)
+
+	if err != nil {
+		return err
+	}
+
+	return jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(valuesBytes, entity)
+}
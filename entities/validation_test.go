@@ -0,0 +1,112 @@
+package entities
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func fieldNames(fieldErrors []*FieldError) string {
+
+	names := make([]string, 0, len(fieldErrors))
+
+	for _, fieldError := range fieldErrors {
+		names = append(names, fieldError.Field)
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+func TestValidate(t *testing.T) {
+
+	validUser := func() map[string]interface{} {
+		return map[string]interface{}{
+			"id":         float64(1),
+			"email":      "anna@mail.ru",
+			"first_name": "Anna",
+			"last_name":  "Petrova",
+			"gender":     "f",
+			"birth_date": float64(-100),
+		}
+	}
+
+	with := func(values map[string]interface{}, name string, value interface{}) map[string]interface{} {
+		values[name] = value
+		return values
+	}
+
+	without := func(values map[string]interface{}, names ...string) map[string]interface{} {
+
+		for _, name := range names {
+			delete(values, name)
+		}
+
+		return values
+	}
+
+	testCases := []struct {
+		name       string
+		values     map[string]interface{}
+		mode       ValidationMode
+		wantErrors string
+	}{
+		{"valid create", validUser(), ValidateCreate, ""},
+		{"missing on create", without(validUser(), "id", "gender"), ValidateCreate, "gender,id"},
+		{"key taken from the path on replace", without(validUser(), "id"), ValidateReplace, ""},
+		{"missing on replace", without(validUser(), "email"), ValidateReplace, "email"},
+		{"partial patch", map[string]interface{}{"first_name": "Anya"}, ValidatePatch, ""},
+		{"empty patch", map[string]interface{}{}, ValidatePatch, ""},
+		{"null on patch", map[string]interface{}{"last_name": nil}, ValidatePatch, "last_name"},
+		{"null on create", with(validUser(), "birth_date", nil), ValidateCreate, "birth_date"},
+		{"string instead of integer", with(validUser(), "birth_date", "1"), ValidateCreate, "birth_date"},
+		{"fraction", with(validUser(), "birth_date", 1.5), ValidateCreate, "birth_date"},
+		{"negative unsigned", with(validUser(), "id", float64(-1)), ValidateCreate, "id"},
+		{"integer instead of string", with(validUser(), "first_name", float64(1)), ValidateCreate, "first_name"},
+		{"too long", with(validUser(), "last_name", strings.Repeat("a", 51)), ValidateCreate, "last_name"},
+		{"longest", with(validUser(), "last_name", strings.Repeat("a", 50)), ValidateCreate, ""},
+		{"not an email", with(validUser(), "email", "anna"), ValidateCreate, "email"},
+		{"not in enum", map[string]interface{}{"gender": "x"}, ValidatePatch, "gender"},
+		{"unknown fields are ignored", with(validUser(), "nickname", float64(1)), ValidateCreate, ""},
+	}
+
+	for _, testCase := range testCases {
+
+		fieldErrors := UserRules.Validate(testCase.values, testCase.mode)
+
+		if gotErrors := fieldNames(fieldErrors); gotErrors != testCase.wantErrors {
+			t.Errorf("%s: errors on %q, want %q", testCase.name, gotErrors, testCase.wantErrors)
+		}
+	}
+}
+
+func TestValidateRange(t *testing.T) {
+
+	entityRules := EntityRules{{Name: "mark", Type: IntField, Range: &Range{Min: 0, Max: 5}}}
+
+	testCases := []struct {
+		value      float64
+		wantReason string
+	}{
+		{0, ""},
+		{5, ""},
+		{-1, "must be between 0 and 5"},
+		{6, "must be between 0 and 5"},
+	}
+
+	for _, testCase := range testCases {
+
+		fieldErrors := entityRules.Validate(map[string]interface{}{"mark": testCase.value}, ValidatePatch)
+
+		reason := ""
+
+		if len(fieldErrors) != 0 {
+			reason = fieldErrors[0].Reason
+		}
+
+		if reason != testCase.wantReason {
+			t.Errorf("%v: reason %q, want %q", testCase.value, reason, testCase.wantReason)
+		}
+	}
+}
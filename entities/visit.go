@@ -1,5 +1,7 @@
 package entities
 
+import "math"
+
 type Visit struct {
 	Mark      *int  `json:"mark, omitempty"`
 	VisitedAt *int  `json:"visited_at, omitempty"`
@@ -10,4 +12,12 @@ type Visit struct {
 
 type VisitCollection struct {
 	Visits []*Visit `json:"visits"`
-}
\ No newline at end of file
+}
+
+var VisitRules = EntityRules{
+	{Name: "id", Type: UintField, Key: true, Required: true},
+	{Name: "location", Type: UintField, Required: true, Range: &Range{Min: 1, Max: math.MaxUint32}},
+	{Name: "user", Type: UintField, Required: true, Range: &Range{Min: 1, Max: math.MaxUint32}},
+	{Name: "visited_at", Type: IntField, Required: true},
+	{Name: "mark", Type: IntField, Required: true, Range: &Range{Min: 0, Max: 5}},
+}
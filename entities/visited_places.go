@@ -1,13 +1,47 @@
 package entities
 
+import (
+	"encoding/json"
+	"sort"
+)
+
 type VisitedPlace struct {
 	Mark      int    `json:"mark"`
 	VisitedAt int    `json:"visited_at"`
 	Place     string `json:"place"`
+	Distance  uint   `json:"-"`
+	Location  uint   `json:"-"`
+	Country   string `json:"-"`
+	City      string `json:"-"`
+	//LocationEntity is the stored location, set only when it is expanded
+	LocationEntity json.RawMessage `json:"location,omitempty"`
+	//computed attributes, set only when they are requested with fields=
+	ComputedCountry  *string `json:"country,omitempty"`
+	ComputedCity     *string `json:"city,omitempty"`
+	ComputedDistance *uint   `json:"distance,omitempty"`
+}
+
+// Compute sets the computed attributes among fields
+func (visitedPlace *VisitedPlace) Compute(fields []string) {
+
+	for _, field := range fields {
+
+		switch field {
+		case "country":
+			visitedPlace.ComputedCountry = &visitedPlace.Country
+		case "city":
+			visitedPlace.ComputedCity = &visitedPlace.City
+		case "distance":
+			visitedPlace.ComputedDistance = &visitedPlace.Distance
+		}
+	}
 }
 
 type VisitedPlaceCollection struct {
 	VisitedPlaces []*VisitedPlace `json:"visits"`
+	Next          string          `json:"next,omitempty"`
+	sortBy        string
+	descending    bool
 }
 
 func (visitedPlaceCollection *VisitedPlaceCollection) Len() int {
@@ -19,5 +53,36 @@ func (visitedPlaceCollection *VisitedPlaceCollection) Swap(i, j int) {
 }
 
 func (visitedPlaceCollection *VisitedPlaceCollection) Less(i, j int) bool {
-	return visitedPlaceCollection.VisitedPlaces[i].VisitedAt < visitedPlaceCollection.VisitedPlaces[j].VisitedAt
-}
\ No newline at end of file
+
+	first, second := visitedPlaceCollection.VisitedPlaces[i], visitedPlaceCollection.VisitedPlaces[j]
+
+	if visitedPlaceCollection.descending {
+		first, second = second, first
+	}
+
+	switch visitedPlaceCollection.sortBy {
+	case "mark":
+		if first.Mark != second.Mark {
+			return first.Mark < second.Mark
+		}
+	case "distance":
+		if first.Distance != second.Distance {
+			return first.Distance < second.Distance
+		}
+	case "place":
+		if first.Place != second.Place {
+			return first.Place < second.Place
+		}
+	}
+
+	return first.VisitedAt < second.VisitedAt
+}
+
+// SortBy orders the places by mark, distance, place or visited_at, ties are ordered by visited_at
+func (visitedPlaceCollection *VisitedPlaceCollection) SortBy(sortBy string, descending bool) {
+
+	visitedPlaceCollection.sortBy = sortBy
+	visitedPlaceCollection.descending = descending
+
+	sort.Stable(visitedPlaceCollection)
+}
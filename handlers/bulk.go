@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/json-iterator/go"
+	"hlcup_epoll/entities"
+	"io"
+	"net/http"
+)
+
+const maxBulkLineSize = 1024 * 1024
+
+// bulkItem is a validated entity which is not written yet, rollback removes it again once it is committed
+type bulkItem struct {
+	id       uint
+	commit   func() []*entities.FieldError
+	rollback func()
+}
+
+// bulkBatch keeps the keys of the validated items of one request,
+// so duplicates inside an all-or-nothing batch are caught before anything is written
+type bulkBatch struct {
+	ids    map[uint]bool
+	emails map[string]bool
+}
+
+type bulkPrepare func(entityMap map[string]interface{}, batch *bulkBatch) (*bulkItem, []*entities.FieldError)
+
+type bulkInput struct {
+	entityMap map[string]interface{}
+	reason    string
+}
+
+func newBulkBatch() *bulkBatch {
+	return &bulkBatch{ids: make(map[uint]bool), emails: make(map[string]bool)}
+}
+
+// runBulk applies the items of a JSON array or NDJSON body in order.
+// mode=atomic (default) writes nothing unless every item is valid and committed, the items committed before a failed one
+// are rolled back. mode=best_effort writes every valid item.
+func runBulk(request *http.Request, prepare bulkPrepare) ([]byte, int) {
+
+	atomic := true
+
+	if value, ok := request.URL.Query()["mode"]; ok {
+
+		switch value[0] {
+		case "atomic":
+			atomic = true
+		case "best_effort":
+			atomic = false
+		default:
+			return fieldFailed("mode", "must be one of [atomic best_effort]")
+		}
+	}
+
+	inputs, ok := decodeBulkInputs(request.Body)
+
+	if !ok {
+		return nil, 400
+	}
+
+	bulkResult := &entities.BulkResult{Results: make([]*entities.BulkItemResult, 0, len(inputs))}
+	items := make([]*bulkItem, len(inputs))
+	batch := newBulkBatch()
+
+	for index, input := range inputs {
+
+		itemResult := &entities.BulkItemResult{Index: index}
+
+		bulkResult.Results = append(bulkResult.Results, itemResult)
+
+		var fieldErrors []*entities.FieldError
+
+		if input.entityMap == nil {
+			fieldErrors = []*entities.FieldError{{Field: "item", Reason: input.reason}}
+		} else {
+			items[index], fieldErrors = prepare(input.entityMap, batch)
+		}
+
+		if len(fieldErrors) != 0 {
+			itemResult.Status = entities.BulkItemFailed
+			itemResult.Errors = fieldErrors
+			bulkResult.Failed++
+			continue
+		}
+
+		itemResult.Id = &items[index].id
+
+		if !atomic {
+			commitBulkItem(items[index], itemResult, bulkResult)
+		}
+	}
+
+	if atomic && bulkResult.Failed != 0 {
+
+		for _, itemResult := range bulkResult.Results {
+
+			if itemResult.Status == "" {
+				itemResult.Status = entities.BulkItemSkipped
+			}
+		}
+
+		return marshalBulkResult(bulkResult, 400)
+	}
+
+	if atomic {
+
+		for index, item := range items {
+
+			if !commitBulkItem(item, bulkResult.Results[index], bulkResult) {
+
+				rollbackBulk(items[:index], bulkResult)
+
+				return marshalBulkResult(bulkResult, 400)
+			}
+		}
+	}
+
+	return marshalBulkResult(bulkResult, 200)
+}
+
+func commitBulkItem(item *bulkItem, itemResult *entities.BulkItemResult, bulkResult *entities.BulkResult) bool {
+
+	fieldErrors := item.commit()
+
+	if len(fieldErrors) != 0 {
+		itemResult.Status = entities.BulkItemFailed
+		itemResult.Errors = fieldErrors
+		bulkResult.Failed++
+		return false
+	}
+
+	itemResult.Status = entities.BulkItemCreated
+	bulkResult.Created++
+
+	return true
+}
+
+// rollbackBulk removes the committed items of an atomic batch in reverse order, they and the items after the failed one are skipped
+func rollbackBulk(committedItems []*bulkItem, bulkResult *entities.BulkResult) {
+
+	for index := len(committedItems) - 1; index >= 0; index-- {
+		committedItems[index].rollback()
+	}
+
+	for _, itemResult := range bulkResult.Results {
+
+		if itemResult.Status != entities.BulkItemFailed {
+			itemResult.Status = entities.BulkItemSkipped
+		}
+	}
+
+	bulkResult.Created = 0
+}
+
+func marshalBulkResult(bulkResult *entities.BulkResult, code int) ([]byte, int) {
+
+	bulkResultBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(bulkResult)
+
+	if err != nil {
+		return nil, 400
+	}
+
+	return bulkResultBytes, code
+}
+
+// decodeBulkInputs reads a JSON array when the body starts with '[' and NDJSON otherwise
+func decodeBulkInputs(body io.Reader) ([]*bulkInput, bool) {
+
+	bufReader := bufio.NewReader(body)
+
+	inputs := make([]*bulkInput, 0)
+
+	for {
+
+		firstByte, err := bufReader.ReadByte()
+
+		if err == io.EOF {
+			return inputs, true
+		}
+
+		if err != nil {
+			return nil, false
+		}
+
+		if firstByte == ' ' || firstByte == '\t' || firstByte == '\r' || firstByte == '\n' {
+			continue
+		}
+
+		bufReader.UnreadByte()
+
+		if firstByte == '[' {
+			break
+		}
+
+		return decodeNDJSONInputs(bufReader)
+	}
+
+	values := make([]interface{}, 0)
+
+	err := jsoniter.NewDecoder(bufReader).Decode(&values)
+
+	if err != nil {
+		return nil, false
+	}
+
+	for _, value := range values {
+		inputs = append(inputs, bulkInputOf(value))
+	}
+
+	return inputs, true
+}
+
+func decodeNDJSONInputs(reader io.Reader) ([]*bulkInput, bool) {
+
+	inputs := make([]*bulkInput, 0)
+
+	scanner := bufio.NewScanner(reader)
+
+	scanner.Buffer(make([]byte, 0, 4096), maxBulkLineSize)
+
+	for scanner.Scan() {
+
+		line := bytes.TrimSpace(scanner.Bytes())
+
+		if len(line) == 0 {
+			continue
+		}
+
+		var value interface{}
+
+		err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(line, &value)
+
+		if err != nil {
+			inputs = append(inputs, &bulkInput{reason: "malformed JSON"})
+			continue
+		}
+
+		inputs = append(inputs, bulkInputOf(value))
+	}
+
+	if scanner.Err() != nil {
+		return nil, false
+	}
+
+	return inputs, true
+}
+
+func bulkInputOf(value interface{}) *bulkInput {
+
+	entityMap, ok := value.(map[string]interface{})
+
+	if !ok {
+		return &bulkInput{reason: "must be a JSON object"}
+	}
+
+	return &bulkInput{entityMap: entityMap}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"github.com/json-iterator/go"
+	"hlcup_epoll/entities"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeStore is a bulk target whose items fail validation with "invalid" and fail their commit with "fail_commit"
+type fakeStore struct {
+	committed map[uint]bool
+}
+
+func (store *fakeStore) prepare(entityMap map[string]interface{}, batch *bulkBatch) (*bulkItem, []*entities.FieldError) {
+
+	if entityMap["invalid"] == true {
+		return nil, []*entities.FieldError{{Field: "invalid", Reason: "is set"}}
+	}
+
+	id := uint(entityMap["id"].(float64))
+	failCommit := entityMap["fail_commit"] == true
+
+	commit := func() []*entities.FieldError {
+
+		if failCommit {
+			return []*entities.FieldError{{Field: "id", Reason: "commit failed"}}
+		}
+
+		store.committed[id] = true
+
+		return nil
+	}
+
+	rollback := func() {
+
+		delete(store.committed, id)
+	}
+
+	return &bulkItem{id: id, commit: commit, rollback: rollback}, nil
+}
+
+func TestRunBulk(t *testing.T) {
+
+	testCases := []struct {
+		name          string
+		mode          string
+		body          string
+		wantCode      int
+		wantCreated   int
+		wantFailed    int
+		wantCommitted []uint
+		wantStatuses  []string
+	}{
+		{
+			name:          "atomic all valid",
+			body:          `[{"id":1},{"id":2}]`,
+			wantCode:      200,
+			wantCreated:   2,
+			wantCommitted: []uint{1, 2},
+			wantStatuses:  []string{entities.BulkItemCreated, entities.BulkItemCreated},
+		},
+		{
+			name:         "atomic invalid item writes nothing",
+			mode:         "atomic",
+			body:         `[{"id":1},{"invalid":true},{"id":3}]`,
+			wantCode:     400,
+			wantFailed:   1,
+			wantStatuses: []string{entities.BulkItemSkipped, entities.BulkItemFailed, entities.BulkItemSkipped},
+		},
+		{
+			name:         "atomic failed commit rolls back",
+			mode:         "atomic",
+			body:         `[{"id":1},{"id":2},{"id":3,"fail_commit":true},{"id":4}]`,
+			wantCode:     400,
+			wantFailed:   1,
+			wantStatuses: []string{entities.BulkItemSkipped, entities.BulkItemSkipped, entities.BulkItemFailed, entities.BulkItemSkipped},
+		},
+		{
+			name:          "best effort keeps valid items",
+			mode:          "best_effort",
+			body:          "{\"id\":1}\n{\"invalid\":true}\n{\"id\":3,\"fail_commit\":true}\nnot json\n{\"id\":5}\n",
+			wantCode:      200,
+			wantCreated:   2,
+			wantFailed:    3,
+			wantCommitted: []uint{1, 5},
+			wantStatuses:  []string{entities.BulkItemCreated, entities.BulkItemFailed, entities.BulkItemFailed, entities.BulkItemFailed, entities.BulkItemCreated},
+		},
+		{
+			name:     "unknown mode",
+			mode:     "partial",
+			body:     `[{"id":1}]`,
+			wantCode: 400,
+		},
+		{
+			name:     "malformed array",
+			body:     `[{"id":1}`,
+			wantCode: 400,
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		store := &fakeStore{committed: make(map[uint]bool)}
+
+		url := "/visits/bulk"
+
+		if testCase.mode != "" {
+			url += "?mode=" + testCase.mode
+		}
+
+		request := httptest.NewRequest("POST", url, strings.NewReader(testCase.body))
+
+		responseBytes, code := runBulk(request, store.prepare)
+
+		if code != testCase.wantCode {
+			t.Errorf("%s: code = %d, want %d", testCase.name, code, testCase.wantCode)
+			continue
+		}
+
+		if len(store.committed) != len(testCase.wantCommitted) {
+			t.Errorf("%s: committed = %v, want %v", testCase.name, store.committed, testCase.wantCommitted)
+		}
+
+		for _, id := range testCase.wantCommitted {
+
+			if !store.committed[id] {
+				t.Errorf("%s: item %d is not committed", testCase.name, id)
+			}
+		}
+
+		if testCase.wantStatuses == nil {
+			continue
+		}
+
+		bulkResult := new(entities.BulkResult)
+
+		err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(responseBytes, bulkResult)
+
+		if err != nil {
+			t.Errorf("%s: %v", testCase.name, err)
+			continue
+		}
+
+		if bulkResult.Created != testCase.wantCreated || bulkResult.Failed != testCase.wantFailed {
+			t.Errorf("%s: created %d failed %d, want %d and %d", testCase.name, bulkResult.Created, bulkResult.Failed, testCase.wantCreated, testCase.wantFailed)
+		}
+
+		if len(bulkResult.Results) != len(testCase.wantStatuses) {
+			t.Errorf("%s: %d results, want %d", testCase.name, len(bulkResult.Results), len(testCase.wantStatuses))
+			continue
+		}
+
+		for index, itemResult := range bulkResult.Results {
+
+			if itemResult.Status != testCase.wantStatuses[index] {
+				t.Errorf("%s: item %d is %s, want %s", testCase.name, index, itemResult.Status, testCase.wantStatuses[index])
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"github.com/asaskevich/govalidator"
+	"hlcup_epoll/entities"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var demographicGenders = []string{"f", "m"}
+
+// parseAgeBuckets reads comma separated ascending age boundaries, e.g. "18,25,35"
+func parseAgeBuckets(ageBucketsString string) ([]int, bool) {
+
+	ageBuckets := make([]int, 0)
+
+	for _, boundaryString := range strings.Split(ageBucketsString, ",") {
+
+		if !govalidator.IsInt(boundaryString) || boundaryString == "" {
+			return nil, false
+		}
+
+		boundary, err := strconv.Atoi(boundaryString)
+
+		if err != nil || boundary <= 0 || (len(ageBuckets) != 0 && boundary <= ageBuckets[len(ageBuckets)-1]) {
+			return nil, false
+		}
+
+		ageBuckets = append(ageBuckets, boundary)
+	}
+
+	return ageBuckets, true
+}
+
+// newAgeGroups returns one group below the first boundary, one per pair of boundaries and one from the last boundary
+func newAgeGroups(ageBuckets []int) []*entities.DemographicGroup {
+
+	ageGroups := make([]*entities.DemographicGroup, 0, len(ageBuckets)+1)
+
+	from := 0
+
+	for _, boundary := range ageBuckets {
+
+		ageGroups = append(ageGroups, &entities.DemographicGroup{Group: strconv.Itoa(from) + "-" + strconv.Itoa(boundary-1)})
+
+		from = boundary
+	}
+
+	return append(ageGroups, &entities.DemographicGroup{Group: strconv.Itoa(from) + "+"})
+}
+
+// ageGroupIndex returns the index of the age group of a user born at birthDate, ages are counted at timeDataGeneration
+func ageGroupIndex(birthDate int, ageBuckets []int, timeDataGeneration time.Time) int {
+
+	for index, boundary := range ageBuckets {
+
+		if int(timeDataGeneration.AddDate(-boundary, 0, 0).Unix()) < birthDate {
+			return index
+		}
+	}
+
+	return len(ageBuckets)
+}
+
+// averageGroups turns the sums of marks into averages
+func averageGroups(groups []*entities.DemographicGroup, sumsOfMarks []int) {
+
+	for index, group := range groups {
+
+		if group.Count != 0 {
+			group.Avg = math.Round(float64(sumsOfMarks[index])/float64(group.Count)*100000) / 100000
+		}
+	}
+}
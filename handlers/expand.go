@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// parseExpand reads expand as a comma separated list of allowedRelations, e.g. expand=user,location
+func parseExpand(request *http.Request, allowedRelations []string) (map[string]bool, bool) {
+
+	return parseOptions(request, "expand", allowedRelations)
+}
+
+// parseInclude reads include as a comma separated list of allowedAttributes, e.g. include=age,visit_count
+func parseInclude(request *http.Request, allowedAttributes []string) (map[string]bool, bool) {
+
+	return parseOptions(request, "include", allowedAttributes)
+}
+
+func parseOptions(request *http.Request, parameter string, allowedOptions []string) (map[string]bool, bool) {
+
+	options := make(map[string]bool)
+
+	value, ok := request.URL.Query()[parameter]
+
+	if !ok {
+		return options, true
+	}
+
+	for _, option := range strings.Split(string(value[0]), ",") {
+
+		isAllowed := false
+
+		for _, allowedOption := range allowedOptions {
+
+			if option == allowedOption {
+				isAllowed = true
+				break
+			}
+		}
+
+		if !isAllowed {
+			return nil, false
+		}
+
+		options[option] = true
+	}
+
+	return options, true
+}
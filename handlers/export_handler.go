@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/asaskevich/govalidator"
+	"hlcup_epoll/entities"
+	"hlcup_epoll/indexes"
+	"hlcup_epoll/services"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type ExportApiHandler struct {
+	storage    *services.Storage
+	errLogger  *log.Logger
+	infoLogger *log.Logger
+}
+
+func NewExportApiHandler(storage *services.Storage, errLogger *log.Logger, infoLogger *log.Logger) *ExportApiHandler {
+
+	return &ExportApiHandler{storage: storage, errLogger: errLogger, infoLogger: infoLogger}
+}
+
+// Export returns a point-in-time snapshot of users, locations or visits with ids in the inclusive range [fromId, toId]
+// and the attributes requested with fields=, every entity is projected by ProjectEntity while it is streamed
+func (exportApiHandler *ExportApiHandler) Export(request *http.Request, entityName string) (*indexes.Snapshot, []string, int) {
+
+	fromId := uint(0)
+	toId := ^uint(0)
+
+	if value, ok := request.URL.Query()["fromId"]; ok {
+
+		fromIdString := string(value[0])
+
+		if !govalidator.IsNumeric(fromIdString) || fromIdString == "" {
+			return nil, nil, 400
+		}
+
+		fromIdInt, err := strconv.Atoi(fromIdString)
+
+		if err != nil {
+			return nil, nil, 400
+		}
+
+		fromId = uint(fromIdInt)
+	}
+
+	if value, ok := request.URL.Query()["toId"]; ok {
+
+		toIdString := string(value[0])
+
+		if !govalidator.IsNumeric(toIdString) || toIdString == "" {
+			return nil, nil, 400
+		}
+
+		toIdInt, err := strconv.Atoi(toIdString)
+
+		if err != nil {
+			return nil, nil, 400
+		}
+
+		toId = uint(toIdInt)
+	}
+
+	fields, ok := parseFields(request)
+
+	if !ok {
+		return nil, nil, 400
+	}
+
+	var entityRules entities.EntityRules
+
+	switch entityName {
+	case "users":
+		entityRules = entities.UserRules
+	case "locations":
+		entityRules = entities.LocationRules
+	case "visits":
+		entityRules = entities.VisitRules
+	default:
+		return nil, nil, 404
+	}
+
+	//the stored entities have the attributes of their rules, so the unknown fields are refused before anything is sent
+	for _, field := range fields {
+
+		if !hasRule(entityRules, field) {
+			return nil, nil, 400
+		}
+	}
+
+	var snapshot *indexes.Snapshot
+
+	switch entityName {
+	case "users":
+		snapshot = exportApiHandler.storage.SnapshotUsers(fromId, toId)
+	case "locations":
+		snapshot = exportApiHandler.storage.SnapshotLocations(fromId, toId)
+	default:
+		snapshot = exportApiHandler.storage.SnapshotVisits(fromId, toId)
+	}
+
+	return snapshot, fields, 200
+}
+
+func hasRule(entityRules entities.EntityRules, name string) bool {
+
+	for _, fieldRule := range entityRules {
+
+		if fieldRule.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ProjectEntity keeps only the fields of one encoded entity, the stored bytes are not modified
+func ProjectEntity(entityBytes []byte, fields []string) []byte {
+
+	entity := make(map[string]json.RawMessage)
+
+	err := json.Unmarshal(entityBytes, &entity)
+
+	if err != nil {
+		return entityBytes
+	}
+
+	projectedBytes, _ := projectObject(entityBytes, entity, fields)
+
+	return projectedBytes
+}
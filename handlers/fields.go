@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// parseFields reads fields as a comma separated list of attribute names, nil means all attributes
+func parseFields(request *http.Request) ([]string, bool) {
+
+	value, ok := request.URL.Query()["fields"]
+
+	if !ok {
+		return nil, true
+	}
+
+	fields := strings.Split(string(value[0]), ",")
+
+	for _, field := range fields {
+
+		if field == "" {
+			return nil, false
+		}
+	}
+
+	return fields, true
+}
+
+// ProjectFields keeps only the attributes requested with fields= in a JSON object response.
+// When some of them are not attributes of the object itself, the object is a collection
+// and every item of its array of objects is projected instead, the other keys (like next) are kept.
+func ProjectFields(request *http.Request, responseBytes []byte) ([]byte, int) {
+
+	fields, ok := parseFields(request)
+
+	if !ok {
+		return fieldFailed("fields", "must be a comma separated list of attributes")
+	}
+
+	if fields == nil {
+		return responseBytes, 200
+	}
+
+	object := make(map[string]json.RawMessage)
+
+	err := json.Unmarshal(responseBytes, &object)
+
+	if err != nil {
+		return responseBytes, 200
+	}
+
+	projectedBytes, unknownField := projectObject(responseBytes, object, fields)
+
+	if unknownField == "" {
+		return projectedBytes, 200
+	}
+
+	collectionKey := ""
+
+	for key, value := range object {
+
+		if len(value) != 0 && value[0] == '[' {
+
+			if collectionKey != "" {
+				return fieldFailed("fields", "unknown attribute "+unknownField)
+			}
+
+			collectionKey = key
+		}
+	}
+
+	if collectionKey == "" {
+		return fieldFailed("fields", "unknown attribute "+unknownField)
+	}
+
+	items := make([]json.RawMessage, 0)
+
+	err = json.Unmarshal(object[collectionKey], &items)
+
+	if err != nil {
+		return fieldFailed("fields", "unknown attribute "+unknownField)
+	}
+
+	projectedItems, unknownField := projectItems(items, fields)
+
+	if unknownField != "" {
+		return fieldFailed("fields", "unknown attribute "+unknownField)
+	}
+
+	object[collectionKey] = projectedItems
+
+	projectedBytes, err = json.Marshal(object)
+
+	if err != nil {
+		return nil, 400
+	}
+
+	return projectedBytes, 200
+}
+
+// projectItems projects every object of a collection, an attribute is unknown when no item has it
+func projectItems(items []json.RawMessage, fields []string) (json.RawMessage, string) {
+
+	knownFields := make(map[string]bool)
+	projectedItems := make([]json.RawMessage, 0, len(items))
+
+	for _, item := range items {
+
+		itemObject := make(map[string]json.RawMessage)
+
+		err := json.Unmarshal(item, &itemObject)
+
+		if err != nil {
+			return nil, fields[0]
+		}
+
+		presentFields := make([]string, 0, len(fields))
+
+		for _, field := range fields {
+
+			if _, ok := itemObject[field]; ok {
+				knownFields[field] = true
+				presentFields = append(presentFields, field)
+			}
+		}
+
+		projectedItem, _ := projectObject(item, itemObject, presentFields)
+
+		projectedItems = append(projectedItems, projectedItem)
+	}
+
+	if len(items) != 0 {
+
+		for _, field := range fields {
+
+			if !knownFields[field] {
+				return nil, field
+			}
+		}
+	}
+
+	projectedItemsBytes, err := json.Marshal(projectedItems)
+
+	if err != nil {
+		return nil, fields[0]
+	}
+
+	return projectedItemsBytes, ""
+}
+
+// projectObject writes the requested attributes in the requested order, the values are copied as they are.
+// It returns the first attribute missing from the object instead, if any.
+func projectObject(objectBytes []byte, object map[string]json.RawMessage, fields []string) ([]byte, string) {
+
+	projectedBytes := bytes.NewBufferString("{")
+
+	for index, field := range fields {
+
+		value, ok := object[field]
+
+		if !ok {
+			return objectBytes, field
+		}
+
+		if index != 0 {
+			projectedBytes.WriteByte(',')
+		}
+
+		fieldBytes, _ := json.Marshal(field)
+
+		projectedBytes.Write(fieldBytes)
+		projectedBytes.WriteByte(':')
+		projectedBytes.Write(value)
+	}
+
+	projectedBytes.WriteByte('}')
+
+	return projectedBytes.Bytes(), ""
+}
@@ -1,24 +1,34 @@
 package handlers
 
 import (
-	"hlcup_epoll/services"
-	"log"
-	"github.com/asaskevich/govalidator"
-	"strconv"
-	"os"
 	"bufio"
-	"time"
+	"github.com/asaskevich/govalidator"
+	"github.com/json-iterator/go"
 	"hlcup_epoll/entities"
+	"hlcup_epoll/services"
+	"log"
 	"math"
-	"github.com/json-iterator/go"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
 )
 
+const defaultTopLimit = 10
+const maxTopLimit = 1000
+
+var locationVisitsSorts = []string{"visited_at", "mark", "user"}
+var visitorsSorts = []string{"user", "visits"}
+
 type LocationApiHandler struct {
 	storage            *services.Storage
 	errLogger          *log.Logger
 	infoLogger         *log.Logger
 	timeDataGeneration time.Time
+	timezone           *time.Location
+	ageBuckets         []int
+	filterRegistry     *services.FilterRegistry
 }
 
 func NewLocationApiHandler(storage *services.Storage, errLogger *log.Logger, infoLogger *log.Logger, pathToOptions string) *LocationApiHandler {
@@ -35,7 +45,25 @@ func NewLocationApiHandler(storage *services.Storage, errLogger *log.Logger, inf
 		errLogger.Fatalln(err)
 	}
 
-	return &LocationApiHandler{storage: storage, errLogger: errLogger, infoLogger: infoLogger, timeDataGeneration: time.Unix(int64(timeDataGeneration), 0)}
+	return &LocationApiHandler{storage: storage, errLogger: errLogger, infoLogger: infoLogger, timeDataGeneration: time.Unix(int64(timeDataGeneration), 0), timezone: time.UTC, ageBuckets: []int{18, 25, 35, 45, 55, 65}, filterRegistry: services.NewFilterRegistry(services.UnknownParamsIgnore)}
+}
+
+// SetFilterRegistry sets the registry which parses the filters of the query parameters
+func (locationApiHandler *LocationApiHandler) SetFilterRegistry(filterRegistry *services.FilterRegistry) {
+
+	locationApiHandler.filterRegistry = filterRegistry
+}
+
+// SetAgeBuckets sets the ascending age boundaries of the demographics age groups
+func (locationApiHandler *LocationApiHandler) SetAgeBuckets(ageBuckets []int) {
+
+	locationApiHandler.ageBuckets = ageBuckets
+}
+
+// SetTimezone sets the timezone in which trend buckets are computed
+func (locationApiHandler *LocationApiHandler) SetTimezone(timezone *time.Location) {
+
+	locationApiHandler.timezone = timezone
 }
 
 func (locationApiHandler *LocationApiHandler) GetById(request *http.Request, locationIdString string) ([]byte, int) {
@@ -57,331 +85,890 @@ func (locationApiHandler *LocationApiHandler) GetById(request *http.Request, loc
 
 func (locationApiHandler *LocationApiHandler) GetAverageMark(request *http.Request, locationIdString string) ([]byte, int) {
 
-	locationIdInt, err := strconv.Atoi(locationIdString)
+	filter, errorBytes, code := locationApiHandler.parseLocationVisitsFilter(request, locationIdString)
+
+	if code != 200 {
+		return errorBytes, code
+	}
+
+	visitCollection := locationApiHandler.storage.GetVisitsOfLocation(filter)
+
+	if visitCollection == nil {
+		return nil, 404
+	}
+
+	endAggregate := filter.Profile.Phase("aggregate")
+
+	sumOfMarks := 0
+
+	for _, visit := range visitCollection.Visits {
+		sumOfMarks += *visit.Mark
+	}
+
+	locationAvgMark := &entities.LocationAvgMark{Avg: 0}
+
+	if len(visitCollection.Visits) != 0 {
+		locationAvgMark.Avg = math.Round(float64(sumOfMarks)/float64(len(visitCollection.Visits))*100000) / 100000
+	}
+
+	endAggregate()
+
+	locationAvgMarkBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(locationAvgMark)
 
 	if err != nil {
+		locationApiHandler.errLogger.Fatalln(err)
+	}
+
+	return locationAvgMarkBytes, 200
+}
+
+func (locationApiHandler *LocationApiHandler) GetStats(request *http.Request, locationIdString string) ([]byte, int) {
+
+	filter, errorBytes, code := locationApiHandler.parseLocationVisitsFilter(request, locationIdString)
+
+	if code != 200 {
+		return errorBytes, code
+	}
+
+	visitCollection := locationApiHandler.storage.GetVisitsOfLocation(filter)
+
+	if visitCollection == nil {
 		return nil, 404
 	}
 
-	filter := services.InitVisitFilter(locationApiHandler.timeDataGeneration)
+	locationStats := &entities.LocationStats{Histogram: make([]int, 6)}
+	visitors := make(map[uint]bool)
+	marks := make([]int, 0, len(visitCollection.Visits))
+	sumOfMarks := 0
 
-	locationIdUint := uint(locationIdInt)
+	for _, visit := range visitCollection.Visits {
 
-	filter.LocationId = &locationIdUint
+		visitors[*visit.User] = true
+		marks = append(marks, *visit.Mark)
+		sumOfMarks += *visit.Mark
 
-	if value, ok := request.URL.Query()["fromDate"]; ok {
+		if *visit.Mark >= 0 && *visit.Mark < len(locationStats.Histogram) {
+			locationStats.Histogram[*visit.Mark]++
+		}
 
-		fromDateString := string(value[0])
+		if locationStats.FirstVisitAt == nil || *visit.VisitedAt < *locationStats.FirstVisitAt {
+			locationStats.FirstVisitAt = visit.VisitedAt
+		}
 
-		if !govalidator.IsNumeric(fromDateString) || fromDateString == "" {
-			return nil, 400
+		if locationStats.LastVisitAt == nil || *visit.VisitedAt > *locationStats.LastVisitAt {
+			locationStats.LastVisitAt = visit.VisitedAt
 		}
+	}
 
-		fromDateInt, err := strconv.Atoi(fromDateString)
+	locationStats.Count = len(marks)
+	locationStats.Visitors = len(visitors)
 
-		if err != nil {
-			locationApiHandler.errLogger.Println(err)
+	if len(marks) != 0 {
+
+		sort.Ints(marks)
+
+		locationStats.Min = &marks[0]
+		locationStats.Max = &marks[len(marks)-1]
+		locationStats.Mean = math.Round(float64(sumOfMarks)/float64(len(marks))*100000) / 100000
+
+		if len(marks)%2 == 1 {
+			locationStats.Median = float64(marks[len(marks)/2])
+		} else {
+			locationStats.Median = float64(marks[len(marks)/2-1]+marks[len(marks)/2]) / 2
 		}
+	}
+
+	locationStatsBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(locationStats)
 
-		filter.FromDate = &fromDateInt
+	if err != nil {
+		locationApiHandler.errLogger.Fatalln(err)
 	}
 
-	if value, ok := request.URL.Query()["toDate"]; ok {
+	return locationStatsBytes, 200
+}
 
-		toDateString := string(value[0])
+// GetTrend returns the visit count and the average mark per day, week, month or year, ordered by time
+func (locationApiHandler *LocationApiHandler) GetTrend(request *http.Request, locationIdString string) ([]byte, int) {
 
-		if !govalidator.IsNumeric(toDateString) || toDateString == "" {
+	bucket := "day"
+
+	if value, ok := request.URL.Query()["bucket"]; ok {
+
+		bucket = string(value[0])
+
+		if _, ok := trendBucketLayouts[bucket]; !ok {
 			return nil, 400
 		}
+	}
 
-		toDateInt, err := strconv.Atoi(toDateString)
+	filter, errorBytes, code := locationApiHandler.parseLocationVisitsFilter(request, locationIdString)
 
-		if err != nil {
-			locationApiHandler.errLogger.Println(err)
-		}
+	if code != 200 {
+		return errorBytes, code
+	}
+
+	visitCollection := locationApiHandler.storage.GetVisitsOfLocation(filter)
 
-		filter.ToDate = &toDateInt
+	if visitCollection == nil {
+		return nil, 404
 	}
 
-	if value, ok := request.URL.Query()["fromAge"]; ok {
+	bucketsByStart := make(map[int64]*entities.TrendBucket)
+	sumsOfMarks := make(map[int64]int)
 
-		fromAgeString := string(value[0])
+	for _, visit := range visitCollection.Visits {
 
-		if !govalidator.IsNumeric(fromAgeString) || fromAgeString == "" {
-			return nil, 400
-		}
+		start := bucketStart(int64(*visit.VisitedAt), bucket, locationApiHandler.timezone)
 
-		fromAgeInt, err := strconv.Atoi(fromAgeString)
+		trendBucket, ok := bucketsByStart[start.Unix()]
 
-		if err != nil {
-			locationApiHandler.errLogger.Println(err)
+		if !ok {
+			trendBucket = &entities.TrendBucket{Bucket: start.Format(trendBucketLayouts[bucket]), From: start.Unix()}
+			bucketsByStart[start.Unix()] = trendBucket
 		}
 
-		filter.FromAge = &fromAgeInt
+		trendBucket.Count++
+		sumsOfMarks[start.Unix()] += *visit.Mark
 	}
 
-	if value, ok := request.URL.Query()["toAge"]; ok {
+	locationTrend := &entities.LocationTrend{Trend: make([]*entities.TrendBucket, 0, len(bucketsByStart))}
 
-		toAgeString := string(value[0])
+	for start, trendBucket := range bucketsByStart {
 
-		if !govalidator.IsNumeric(toAgeString) || toAgeString == "" {
-			return nil, 400
-		}
+		trendBucket.Avg = math.Round(float64(sumsOfMarks[start])/float64(trendBucket.Count)*100000) / 100000
 
-		toAgeInt, err := strconv.Atoi(toAgeString)
+		locationTrend.Trend = append(locationTrend.Trend, trendBucket)
+	}
 
-		if err != nil {
-			locationApiHandler.errLogger.Println(err)
-		}
+	sort.Slice(locationTrend.Trend, func(i, j int) bool {
+		return locationTrend.Trend[i].From < locationTrend.Trend[j].From
+	})
 
-		filter.ToAge = &toAgeInt
+	locationTrendBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(locationTrend)
+
+	if err != nil {
+		locationApiHandler.errLogger.Fatalln(err)
 	}
 
-	if value, ok := request.URL.Query()["gender"]; ok {
+	return locationTrendBytes, 200
+}
+
+// GetDemographics returns the visit count and the average mark per gender and per age group in one pass over the visits
+func (locationApiHandler *LocationApiHandler) GetDemographics(request *http.Request, locationIdString string) ([]byte, int) {
+
+	ageBuckets := locationApiHandler.ageBuckets
+
+	if value, ok := request.URL.Query()["ageBuckets"]; ok {
 
-		gender := string(value[0])
+		ageBuckets, ok = parseAgeBuckets(string(value[0]))
 
-		if gender == "" || (gender != "m" && gender != "f") {
+		if !ok {
 			return nil, 400
 		}
+	}
+
+	filter, errorBytes, code := locationApiHandler.parseLocationVisitsFilter(request, locationIdString)
 
-		filter.Gender = &gender
+	if code != 200 {
+		return errorBytes, code
 	}
 
-	locationBytes := locationApiHandler.storage.GetLocationById(*filter.LocationId)
+	locationVisits := locationApiHandler.storage.GetLocationVisits(filter)
 
-	if locationBytes == nil {
+	if locationVisits == nil {
 		return nil, 404
 	}
 
-	visitsIds := locationApiHandler.storage.GetVisitsByLocationId(*filter.LocationId)
+	locationDemographics := &entities.LocationDemographics{
+		Gender: make([]*entities.DemographicGroup, 0, len(demographicGenders)),
+		Age:    newAgeGroups(ageBuckets),
+	}
 
-	visitCollection := new(entities.VisitCollection)
-	sumOfMarks := 0
+	for _, gender := range demographicGenders {
+		locationDemographics.Gender = append(locationDemographics.Gender, &entities.DemographicGroup{Group: gender})
+	}
 
-	for _, visitId := range visitsIds {
+	genderSumsOfMarks := make([]int, len(locationDemographics.Gender))
+	ageSumsOfMarks := make([]int, len(locationDemographics.Age))
 
-		visitBytes := locationApiHandler.storage.GetVisitById(visitId)
+	for _, locationVisit := range locationVisits {
 
-		visit := new(entities.Visit)
+		locationDemographics.Count++
 
-		err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(visitBytes, visit)
+		for index, gender := range demographicGenders {
 
-		if err != nil {
-			locationApiHandler.errLogger.Fatalln(err)
+			if *locationVisit.User.Gender == gender {
+				locationDemographics.Gender[index].Count++
+				genderSumsOfMarks[index] += *locationVisit.Visit.Mark
+			}
 		}
 
-		userBytes := locationApiHandler.storage.GetUserById(*visit.User)
+		ageIndex := ageGroupIndex(*locationVisit.User.BirthDate, ageBuckets, locationApiHandler.timeDataGeneration)
+
+		locationDemographics.Age[ageIndex].Count++
+		ageSumsOfMarks[ageIndex] += *locationVisit.Visit.Mark
+	}
 
-		user := new(entities.User)
+	averageGroups(locationDemographics.Gender, genderSumsOfMarks)
+	averageGroups(locationDemographics.Age, ageSumsOfMarks)
 
-		err = jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(userBytes, user)
+	locationDemographicsBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(locationDemographics)
 
-		if err != nil {
-			locationApiHandler.errLogger.Fatalln(err)
-		}
+	if err != nil {
+		locationApiHandler.errLogger.Fatalln(err)
+	}
 
-		if !filter.CheckFromAge(*user.BirthDate) ||
-			!filter.CheckToAge(*user.BirthDate) ||
-			!filter.CheckToDate(*visit.VisitedAt) ||
-			!filter.CheckFromDate(*visit.VisitedAt) ||
-			!filter.CheckGender(*user.Gender) {
-			continue
-		}
+	return locationDemographicsBytes, 200
+}
 
-		sumOfMarks += *visit.Mark
-		visitCollection.Visits = append(visitCollection.Visits, visit)
+// GetVisits returns the visits of a location with their users and marks, ordered by visited_at unless sort is given
+func (locationApiHandler *LocationApiHandler) GetVisits(request *http.Request, locationIdString string) ([]byte, int) {
+
+	filter, errorBytes, code := locationApiHandler.parseLocationVisitsFilter(request, locationIdString)
+
+	if code != 200 {
+		return errorBytes, code
 	}
 
-	locationAvgMark := &entities.LocationAvgMark{Avg: 0}
+	currentPage, ok := parsePage(request)
 
-	if len(visitCollection.Visits) != 0 {
-		locationAvgMark.Avg = math.Round(float64(sumOfMarks)/float64(len(visitCollection.Visits))*100000) / 100000
+	if !ok {
+		return nil, 400
 	}
 
-	locationAvgMarkBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(locationAvgMark)
+	sortBy, descending, ok := parseSort(request, locationVisitsSorts)
+
+	if !ok {
+		return nil, 400
+	}
+
+	locationVisits := locationApiHandler.storage.GetLocationVisits(filter)
+
+	if locationVisits == nil {
+		return nil, 404
+	}
+
+	locationVisitItemCollection := &entities.LocationVisitItemCollection{Visits: make([]*entities.LocationVisitItem, 0, len(locationVisits))}
+
+	for _, locationVisit := range locationVisits {
+
+		locationVisitItemCollection.Visits = append(locationVisitItemCollection.Visits, &entities.LocationVisitItem{
+			Visit:     *locationVisit.Visit.Id,
+			User:      *locationVisit.Visit.User,
+			Mark:      *locationVisit.Visit.Mark,
+			VisitedAt: *locationVisit.Visit.VisitedAt,
+		})
+	}
+
+	locationVisitItemCollection.SortBy(sortBy, descending)
+
+	start, end, next := currentPage.bounds(len(locationVisitItemCollection.Visits))
+
+	locationVisitItemCollection.Visits = locationVisitItemCollection.Visits[start:end]
+	locationVisitItemCollection.Next = next
+
+	locationVisitItemCollectionBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(locationVisitItemCollection)
 
 	if err != nil {
 		locationApiHandler.errLogger.Fatalln(err)
 	}
 
-	return locationAvgMarkBytes, 200
+	return locationVisitItemCollectionBytes, 200
 }
 
-func (locationApiHandler *LocationApiHandler) Update(request *http.Request, locationIdString string) ([]byte, int) {
+// GetVisitors returns the distinct users who visited a location with their visit counts, ordered by user unless sort is given
+func (locationApiHandler *LocationApiHandler) GetVisitors(request *http.Request, locationIdString string) ([]byte, int) {
 
-	locationId, err := strconv.Atoi(locationIdString)
+	filter, errorBytes, code := locationApiHandler.parseLocationVisitsFilter(request, locationIdString)
 
-	if err != nil {
-		return nil, 404
+	if code != 200 {
+		return errorBytes, code
 	}
 
-	locationBytes := locationApiHandler.storage.GetLocationById(uint(locationId))
+	currentPage, ok := parsePage(request)
 
-	if locationBytes == nil {
+	if !ok {
+		return nil, 400
+	}
+
+	sortBy, descending, ok := parseSort(request, visitorsSorts)
+
+	if !ok {
+		return nil, 400
+	}
+
+	locationVisits := locationApiHandler.storage.GetLocationVisits(filter)
+
+	if locationVisits == nil {
 		return nil, 404
 	}
 
-	newLocationMap := make(map[string]interface{})
+	visitorsByUserId := make(map[uint]*entities.Visitor)
 
-	err = jsoniter.NewDecoder(request.Body).Decode(&newLocationMap)
+	visitorCollection := &entities.VisitorCollection{Visitors: make([]*entities.Visitor, 0)}
 
-	if err != nil {
-		return nil, 400
+	for _, locationVisit := range locationVisits {
+
+		visitor, ok := visitorsByUserId[*locationVisit.Visit.User]
+
+		if !ok {
+
+			visitor = &entities.Visitor{User: *locationVisit.Visit.User, FirstName: *locationVisit.User.FirstName, LastName: *locationVisit.User.LastName}
+
+			visitorsByUserId[visitor.User] = visitor
+			visitorCollection.Visitors = append(visitorCollection.Visitors, visitor)
+		}
+
+		visitor.Visits++
 	}
 
-	location := new(entities.Location)
+	visitorCollection.SortBy(sortBy, descending)
+
+	start, end, next := currentPage.bounds(len(visitorCollection.Visitors))
 
-	err = jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(locationBytes, location)
+	visitorCollection.Visitors = visitorCollection.Visitors[start:end]
+	visitorCollection.Next = next
+
+	visitorCollectionBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(visitorCollection)
 
 	if err != nil {
 		locationApiHandler.errLogger.Fatalln(err)
 	}
 
-	if value, ok := newLocationMap["place"]; ok {
+	return visitorCollectionBytes, 200
+}
+
+func (locationApiHandler *LocationApiHandler) GetTop(request *http.Request) ([]byte, int) {
+
+	filter, errorBytes, code := locationApiHandler.parseScopedVisitorFilter(request, services.ScopeLocationVisits|services.ScopeTopLocations)
+
+	if code != 200 {
+		return errorBytes, code
+	}
+
+	rankBy := "avg"
 
-		place, typeOk := value.(string)
+	if value, ok := request.URL.Query()["by"]; ok {
 
-		if value == nil || !typeOk {
+		rankBy = string(value[0])
+
+		if rankBy != "avg" && rankBy != "visits" {
 			return nil, 400
 		}
-
-		location.Place = &place
 	}
 
-	if value, ok := newLocationMap["country"]; ok {
+	limit := defaultTopLimit
 
-		country, typeOk := value.(string)
+	if value, ok := request.URL.Query()["limit"]; ok {
 
-		if value == nil || !typeOk || len(country) > 50 {
+		limitString := string(value[0])
+
+		if !govalidator.IsNumeric(limitString) || limitString == "" {
 			return nil, 400
 		}
 
-		location.Country = &country
+		limit, _ = strconv.Atoi(limitString)
+
+		if limit == 0 || limit > maxTopLimit {
+			return nil, 400
+		}
 	}
 
-	if value, ok := newLocationMap["city"]; ok {
+	minVisits := 1
+
+	if value, ok := request.URL.Query()["minVisits"]; ok {
 
-		city, typeOk := value.(string)
+		minVisitsString := string(value[0])
 
-		if value == nil || !typeOk || len(city) > 50 {
+		if !govalidator.IsNumeric(minVisitsString) || minVisitsString == "" {
 			return nil, 400
 		}
 
-		location.City = &city
+		minVisits, _ = strconv.Atoi(minVisitsString)
+
+		if minVisits == 0 {
+			minVisits = 1
+		}
 	}
 
-	if value, ok := newLocationMap["distance"]; ok {
+	locationsSnapshot := locationApiHandler.storage.SnapshotLocations(0, ^uint(0))
 
-		distance, typeOk := value.(float64)
+	locationRankCollection := &entities.LocationRankCollection{Locations: make([]*entities.LocationRank, 0), RankBy: rankBy}
 
-		if value == nil || !typeOk || distance <= 0 {
-			return nil, 400
+	//the locations are read one batch at a time, the snapshot keeps no copy of them
+	for hasMore := true; hasMore; {
+
+		var locationIds []uint
+		var locationsBytes [][]byte
+
+		locationIds, locationsBytes, hasMore = locationsSnapshot.Next()
+
+		for index, locationId := range locationIds {
+
+			location := new(entities.Location)
+
+			err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(locationsBytes[index], location)
+
+			if err != nil {
+				locationApiHandler.errLogger.Fatalln(err)
+			}
+
+			if !locationApiHandler.filterRegistry.Match(filter, services.ScopeTopLocations, &services.FilterSubject{Location: location}) {
+				continue
+			}
+
+			locationIdUint := locationId
+
+			filter.LocationId = &locationIdUint
+
+			visitCollection := locationApiHandler.storage.GetVisitsOfLocation(filter)
+
+			if visitCollection == nil || len(visitCollection.Visits) < minVisits {
+				continue
+			}
+
+			sumOfMarks := 0
+
+			for _, visit := range visitCollection.Visits {
+				sumOfMarks += *visit.Mark
+			}
+
+			locationRank := &entities.LocationRank{
+				Id:      locationId,
+				Place:   *location.Place,
+				Country: *location.Country,
+				City:    *location.City,
+				Visits:  len(visitCollection.Visits),
+				Avg:     math.Round(float64(sumOfMarks)/float64(len(visitCollection.Visits))*100000) / 100000,
+			}
+
+			locationRankCollection.Locations = append(locationRankCollection.Locations, locationRank)
 		}
+	}
 
-		distanceAsUint := uint(distance)
+	sort.Sort(locationRankCollection)
 
-		location.Distance = &distanceAsUint
+	if len(locationRankCollection.Locations) > limit {
+		locationRankCollection.Locations = locationRankCollection.Locations[:limit]
 	}
 
-	locationApiHandler.storage.AddLocation(location)
+	locationRankCollectionBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(locationRankCollection)
 
-	return []byte("{}"), 200
+	if err != nil {
+		locationApiHandler.errLogger.Fatalln(err)
+	}
+
+	return locationRankCollectionBytes, 200
 }
 
-func (locationApiHandler *LocationApiHandler) Create(request *http.Request) ([]byte, int) {
+func (locationApiHandler *LocationApiHandler) GetCountries(request *http.Request) ([]byte, int) {
+
+	filter, errorBytes, code := locationApiHandler.parseVisitorFilter(request)
+
+	if code != 200 {
+		return errorBytes, code
+	}
+
+	countryCollection := &entities.CountryCollection{Countries: make([]*entities.Region, 0)}
+
+	for _, country := range locationApiHandler.storage.GetCountries() {
+
+		region := locationApiHandler.aggregateRegion(country, locationApiHandler.storage.GetLocationsByCountry(country), filter)
+
+		countryCollection.Countries = append(countryCollection.Countries, region)
+	}
+
+	countryCollectionBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(countryCollection)
+
+	if err != nil {
+		locationApiHandler.errLogger.Fatalln(err)
+	}
+
+	return countryCollectionBytes, 200
+}
+
+func (locationApiHandler *LocationApiHandler) GetCountryAverageMark(request *http.Request, country string) ([]byte, int) {
+
+	return locationApiHandler.getRegionAverageMark(request, country, locationApiHandler.storage.GetLocationsByCountry(country))
+}
+
+func (locationApiHandler *LocationApiHandler) GetCityAverageMark(request *http.Request, city string) ([]byte, int) {
+
+	return locationApiHandler.getRegionAverageMark(request, city, locationApiHandler.storage.GetLocationsByCity(city))
+}
+
+func (locationApiHandler *LocationApiHandler) GetCountryCities(request *http.Request, country string) ([]byte, int) {
+
+	filter, errorBytes, code := locationApiHandler.parseVisitorFilter(request)
+
+	if code != 200 {
+		return errorBytes, code
+	}
+
+	locationsIds := locationApiHandler.storage.GetLocationsByCountry(country)
+
+	if len(locationsIds) == 0 {
+		return nil, 404
+	}
+
+	locationsByCity := make(map[string][]uint)
+
+	for _, locationId := range locationsIds {
+
+		locationBytes := locationApiHandler.storage.GetLocationById(locationId)
+
+		if locationBytes == nil {
+			continue
+		}
 
-	newLocationMap := make(map[string]interface{})
+		location := new(entities.Location)
 
-	err := jsoniter.NewDecoder(request.Body).Decode(&newLocationMap)
+		err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(locationBytes, location)
+
+		if err != nil {
+			locationApiHandler.errLogger.Fatalln(err)
+		}
+
+		locationsByCity[*location.City] = append(locationsByCity[*location.City], locationId)
+	}
+
+	cities := make([]string, 0, len(locationsByCity))
+
+	for city := range locationsByCity {
+		cities = append(cities, city)
+	}
+
+	sort.Strings(cities)
+
+	cityCollection := &entities.CityCollection{Cities: make([]*entities.Region, 0, len(cities))}
+
+	for _, city := range cities {
+		cityCollection.Cities = append(cityCollection.Cities, locationApiHandler.aggregateRegion(city, locationsByCity[city], filter))
+	}
+
+	cityCollectionBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(cityCollection)
 
 	if err != nil {
-		return nil, 400
+		locationApiHandler.errLogger.Fatalln(err)
+	}
+
+	return cityCollectionBytes, 200
+}
+
+func (locationApiHandler *LocationApiHandler) getRegionAverageMark(request *http.Request, name string, locationsIds []uint) ([]byte, int) {
+
+	filter, errorBytes, code := locationApiHandler.parseVisitorFilter(request)
+
+	if code != 200 {
+		return errorBytes, code
+	}
+
+	if len(locationsIds) == 0 {
+		return nil, 404
+	}
+
+	region := locationApiHandler.aggregateRegion(name, locationsIds, filter)
+
+	regionAvgMarkBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(&entities.RegionAvgMark{Avg: region.Avg})
+
+	if err != nil {
+		locationApiHandler.errLogger.Fatalln(err)
+	}
+
+	return regionAvgMarkBytes, 200
+}
+
+func (locationApiHandler *LocationApiHandler) aggregateRegion(name string, locationsIds []uint, filter *services.VisitsFilter) *entities.Region {
+
+	region := &entities.Region{Name: name}
+	sumOfMarks := 0
+
+	for _, locationId := range locationsIds {
+
+		locationIdUint := locationId
+
+		filter.LocationId = &locationIdUint
+
+		visitCollection := locationApiHandler.storage.GetVisitsOfLocation(filter)
+
+		if visitCollection == nil {
+			continue
+		}
+
+		region.Locations++
+		region.Visits += len(visitCollection.Visits)
+
+		for _, visit := range visitCollection.Visits {
+			sumOfMarks += *visit.Mark
+		}
+	}
+
+	if region.Visits != 0 {
+		region.Avg = math.Round(float64(sumOfMarks)/float64(region.Visits)*100000) / 100000
+	}
+
+	return region
+}
+
+// parseLocationVisitsFilter reads the visitor filters shared by the location aggregates
+func (locationApiHandler *LocationApiHandler) parseLocationVisitsFilter(request *http.Request, locationIdString string) (*services.VisitsFilter, []byte, int) {
+
+	locationIdInt, err := strconv.Atoi(locationIdString)
+
+	if err != nil {
+		return nil, nil, 404
+	}
+
+	filter, errorBytes, code := locationApiHandler.parseVisitorFilter(request)
+
+	if code != 200 {
+		return nil, errorBytes, code
+	}
+
+	locationIdUint := uint(locationIdInt)
+
+	filter.LocationId = &locationIdUint
+
+	return filter, nil, 200
+}
+
+// parseVisitorFilter reads the filters by visit and visitor attributes
+func (locationApiHandler *LocationApiHandler) parseVisitorFilter(request *http.Request) (*services.VisitsFilter, []byte, int) {
+
+	return locationApiHandler.parseScopedVisitorFilter(request, services.ScopeLocationVisits)
+}
+
+// parseScopedVisitorFilter reads the filters of the registry which are allowed in scope
+func (locationApiHandler *LocationApiHandler) parseScopedVisitorFilter(request *http.Request, scope services.FilterScope) (*services.VisitsFilter, []byte, int) {
+
+	filter := services.InitVisitFilter(locationApiHandler.timeDataGeneration)
+
+	filter.Profile = services.QueryProfileFrom(request.Context())
+	filter.Profile.Attach()
+
+	if fieldErrors := locationApiHandler.filterRegistry.Parse(request.URL.Query(), scope, filter); len(fieldErrors) != 0 {
+		errorBytes, code := validationFailed(fieldErrors)
+		return nil, errorBytes, code
+	}
+
+	if errorBytes, ok := parseFilterExpression(request, filter); !ok {
+		return nil, errorBytes, 400
+	}
+
+	return filter, nil, 200
+}
+
+func (locationApiHandler *LocationApiHandler) Update(request *http.Request, locationIdString string) ([]byte, int) {
+
+	locationId, err := strconv.Atoi(locationIdString)
+
+	if err != nil {
+		return nil, 404
+	}
+
+	locationBytes := locationApiHandler.storage.GetLocationById(uint(locationId))
+
+	if locationBytes == nil {
+		return nil, 404
 	}
 
-	locationIdInterface, ok := newLocationMap["id"]
+	newLocationMap, ok := decodeEntityMap(request)
 
 	if !ok {
 		return nil, 400
 	}
 
-	locationIdFloat, typeOk := locationIdInterface.(float64)
+	return locationApiHandler.merge(locationBytes, newLocationMap)
+}
 
-	if !typeOk {
-		return nil, 400
+func (locationApiHandler *LocationApiHandler) Patch(request *http.Request, locationIdString string) ([]byte, int) {
+
+	locationId, err := strconv.Atoi(locationIdString)
+
+	if err != nil {
+		return nil, 404
 	}
 
-	locationIdUint := uint(locationIdFloat)
+	locationBytes := locationApiHandler.storage.GetLocationById(uint(locationId))
 
-	locationBytes := locationApiHandler.storage.GetLocationById(locationIdUint)
+	if locationBytes == nil {
+		return nil, 404
+	}
 
-	if locationBytes != nil {
+	if !isMergePatch(request) {
 		return nil, 400
 	}
 
-	placeInterface, ok := newLocationMap["place"]
+	newLocationMap, ok := decodeEntityMap(request)
 
 	if !ok {
 		return nil, 400
 	}
 
-	countryInterface, ok := newLocationMap["country"]
+	if !isIdMatching(newLocationMap, uint(locationId)) {
+		return fieldFailed("id", "does not match the id in the path")
+	}
+
+	return locationApiHandler.merge(locationBytes, newLocationMap)
+}
+
+func (locationApiHandler *LocationApiHandler) Replace(request *http.Request, locationIdString string) ([]byte, int) {
+
+	locationId, err := strconv.Atoi(locationIdString)
+
+	if err != nil {
+		return nil, 404
+	}
+
+	locationBytes := locationApiHandler.storage.GetLocationById(uint(locationId))
+
+	if locationBytes == nil {
+		return nil, 404
+	}
+
+	newLocationMap, ok := decodeEntityMap(request)
 
 	if !ok {
 		return nil, 400
 	}
 
-	cityInterface, ok := newLocationMap["city"]
+	if !isIdMatching(newLocationMap, uint(locationId)) {
+		return fieldFailed("id", "does not match the id in the path")
+	}
 
-	if !ok {
+	fieldErrors := entities.LocationRules.Validate(newLocationMap, entities.ValidateReplace)
+
+	if len(fieldErrors) != 0 {
+		return validationFailed(fieldErrors)
+	}
+
+	locationIdUint := uint(locationId)
+
+	location := &entities.Location{Id: &locationIdUint}
+
+	delete(newLocationMap, "id")
+
+	err = entities.Apply(newLocationMap, location)
+
+	if err != nil {
 		return nil, 400
 	}
 
-	distanceInterface, ok := newLocationMap["distance"]
+	locationApiHandler.storage.AddLocation(location)
+
+	return []byte("{}"), 200
+}
+
+func (locationApiHandler *LocationApiHandler) Create(request *http.Request) ([]byte, int) {
+
+	newLocationMap, ok := decodeEntityMap(request)
 
 	if !ok {
 		return nil, 400
 	}
 
+	item, fieldErrors := locationApiHandler.prepareLocation(newLocationMap, newBulkBatch())
+
+	if len(fieldErrors) == 0 {
+		fieldErrors = item.commit()
+	}
+
+	if len(fieldErrors) != 0 {
+		return validationFailed(fieldErrors)
+	}
+
+	return []byte("{}"), 200
+}
+
+func (locationApiHandler *LocationApiHandler) Bulk(request *http.Request) ([]byte, int) {
+
+	return runBulk(request, locationApiHandler.prepareLocation)
+}
+
+// prepareLocation is the validation path shared by single and bulk creation
+func (locationApiHandler *LocationApiHandler) prepareLocation(newLocationMap map[string]interface{}, batch *bulkBatch) (*bulkItem, []*entities.FieldError) {
+
+	fieldErrors := entities.LocationRules.Validate(newLocationMap, entities.ValidateCreate)
+
+	if len(fieldErrors) != 0 {
+		return nil, fieldErrors
+	}
+
 	location := new(entities.Location)
 
-	location.Id = &locationIdUint
+	err := entities.Apply(newLocationMap, location)
 
-	place, typeOk := placeInterface.(string)
+	if err != nil {
+		return nil, []*entities.FieldError{{Field: "item", Reason: err.Error()}}
+	}
 
-	if !typeOk {
-		return nil, 400
+	if batch.ids[*location.Id] || locationApiHandler.storage.GetLocationById(*location.Id) != nil {
+		return nil, []*entities.FieldError{{Field: "id", Reason: "already exists"}}
 	}
 
-	location.Place = &place
+	batch.ids[*location.Id] = true
 
-	country, typeOk := countryInterface.(string)
+	commit := func() []*entities.FieldError {
 
-	if !typeOk || len(country) > 50 {
-		return nil, 400
+		locationApiHandler.storage.AddLocation(location)
+
+		return nil
 	}
 
-	location.Country = &country
+	rollback := func() {
 
-	city, typeOk := cityInterface.(string)
+		locationApiHandler.storage.DeleteLocation(*location.Id)
+	}
 
-	if !typeOk || len(city) > 50 {
-		return nil, 400
+	return &bulkItem{id: *location.Id, commit: commit, rollback: rollback}, nil
+}
+
+func (locationApiHandler *LocationApiHandler) merge(locationBytes []byte, newLocationMap map[string]interface{}) ([]byte, int) {
+
+	fieldErrors := entities.LocationRules.Validate(newLocationMap, entities.ValidatePatch)
+
+	if len(fieldErrors) != 0 {
+		return validationFailed(fieldErrors)
 	}
 
-	location.City = &city
+	location := new(entities.Location)
 
-	distanceFloat, typeOk := distanceInterface.(float64)
+	err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(locationBytes, location)
 
-	if !typeOk || distanceFloat <= 0 {
-		return nil, 400
+	if err != nil {
+		locationApiHandler.errLogger.Fatalln(err)
 	}
 
-	distance := uint(distanceFloat)
+	delete(newLocationMap, "id")
+
+	err = entities.Apply(newLocationMap, location)
 
-	location.Distance = &distance
+	if err != nil {
+		return nil, 400
+	}
 
 	locationApiHandler.storage.AddLocation(location)
 
 	return []byte("{}"), 200
 }
+
+func (locationApiHandler *LocationApiHandler) Delete(request *http.Request, locationIdString string) ([]byte, int) {
+
+	locationId, err := strconv.Atoi(locationIdString)
+
+	if err != nil {
+		return nil, 404
+	}
+
+	err = locationApiHandler.storage.DeleteLocation(uint(locationId))
+
+	if err == services.ErrEntityNotFound {
+		return nil, 404
+	}
+
+	if err != nil {
+		return nil, 400
+	}
+
+	return []byte("{}"), 200
+}
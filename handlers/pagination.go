@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"github.com/asaskevich/govalidator"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const cursorPrefix = "offset:"
+
+// maxPageLimit is the largest limit of a page, a larger one is rejected
+const maxPageLimit = 10000
+
+type page struct {
+	offset int
+	limit  int
+}
+
+// parsePage reads limit and either offset or cursor, a cursor is the opaque form of the offset of the next page.
+// A zero limit means the page is not limited.
+func parsePage(request *http.Request) (*page, bool) {
+
+	query := request.URL.Query()
+
+	currentPage := new(page)
+
+	if value, ok := query["limit"]; ok {
+
+		limitString := string(value[0])
+
+		if !govalidator.IsNumeric(limitString) || limitString == "" {
+			return nil, false
+		}
+
+		limitInt, err := strconv.Atoi(limitString)
+
+		if err != nil || limitInt == 0 || limitInt > maxPageLimit {
+			return nil, false
+		}
+
+		currentPage.limit = limitInt
+	}
+
+	offsetValue, hasOffset := query["offset"]
+	cursorValue, hasCursor := query["cursor"]
+
+	if hasOffset && hasCursor {
+		return nil, false
+	}
+
+	if hasOffset {
+
+		offsetString := string(offsetValue[0])
+
+		if !govalidator.IsNumeric(offsetString) || offsetString == "" {
+			return nil, false
+		}
+
+		offsetInt, err := strconv.Atoi(offsetString)
+
+		if err != nil {
+			return nil, false
+		}
+
+		currentPage.offset = offsetInt
+	}
+
+	if hasCursor {
+
+		offsetInt, ok := decodeCursor(string(cursorValue[0]))
+
+		if !ok {
+			return nil, false
+		}
+
+		currentPage.offset = offsetInt
+	}
+
+	return currentPage, true
+}
+
+// bounds returns the bounds of the page within total items and the cursor of the next page, if there is one
+func (currentPage *page) bounds(total int) (int, int, string) {
+
+	start := currentPage.offset
+
+	if start > total {
+		start = total
+	}
+
+	if currentPage.limit == 0 || currentPage.limit >= total-start {
+		return start, total, ""
+	}
+
+	end := start + currentPage.limit
+
+	return start, end, encodeCursor(end)
+}
+
+func encodeCursor(offset int) string {
+
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, bool) {
+
+	cursorBytes, err := base64.RawURLEncoding.DecodeString(cursor)
+
+	if err != nil || !strings.HasPrefix(string(cursorBytes), cursorPrefix) {
+		return 0, false
+	}
+
+	offset, err := strconv.Atoi(strings.TrimPrefix(string(cursorBytes), cursorPrefix))
+
+	if err != nil || offset < 0 {
+		return 0, false
+	}
+
+	return offset, true
+}
+
+// parseSort reads order=asc|desc and sort, which must be one of allowedSorts; an empty sort means the default order
+func parseSort(request *http.Request, allowedSorts []string) (string, bool, bool) {
+
+	query := request.URL.Query()
+
+	sortBy := ""
+	descending := false
+
+	if value, ok := query["order"]; ok {
+
+		switch string(value[0]) {
+		case "asc":
+			descending = false
+		case "desc":
+			descending = true
+		default:
+			return "", false, false
+		}
+	}
+
+	if value, ok := query["sort"]; ok {
+
+		sortBy = string(value[0])
+
+		isAllowed := false
+
+		for _, allowedSort := range allowedSorts {
+
+			if sortBy == allowedSort {
+				isAllowed = true
+				break
+			}
+		}
+
+		if !isAllowed {
+			return "", false, false
+		}
+	}
+
+	return sortBy, descending, true
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParsePage(t *testing.T) {
+
+	testCases := []struct {
+		query      string
+		isValid    bool
+		wantOffset int
+		wantLimit  int
+	}{
+		{"", true, 0, 0},
+		{"limit=10", true, 0, 10},
+		{"limit=10&offset=20", true, 20, 10},
+		{"limit=" + strconv.Itoa(maxPageLimit), true, 0, maxPageLimit},
+		{"limit=" + strconv.Itoa(maxPageLimit+1), false, 0, 0},
+		{"offset=1&limit=" + strconv.Itoa(math.MaxInt64), false, 0, 0},
+		{"limit=0", false, 0, 0},
+		{"limit=", false, 0, 0},
+		{"limit=-1", false, 0, 0},
+		{"limit=abc", false, 0, 0},
+		{"offset=-1", false, 0, 0},
+		{"offset=99999999999999999999999", false, 0, 0},
+		{"cursor=" + encodeCursor(30), true, 30, 0},
+		{"cursor=" + encodeCursor(30) + "&offset=30", false, 0, 0},
+		{"cursor=not-base64!", false, 0, 0},
+		{"cursor=" + encodeCursor(-5), false, 0, 0},
+		{"cursor=b2Zmc2V0OmFiYw", false, 0, 0},
+		{"cursor=", false, 0, 0},
+	}
+
+	for _, testCase := range testCases {
+
+		request := httptest.NewRequest("GET", "/users/1/visits?"+testCase.query, nil)
+
+		currentPage, ok := parsePage(request)
+
+		if ok != testCase.isValid {
+			t.Errorf("%q: valid = %v, want %v", testCase.query, ok, testCase.isValid)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		if currentPage.offset != testCase.wantOffset || currentPage.limit != testCase.wantLimit {
+			t.Errorf("%q: page = %+v, want offset %d limit %d", testCase.query, *currentPage, testCase.wantOffset, testCase.wantLimit)
+		}
+	}
+}
+
+func TestPageBounds(t *testing.T) {
+
+	testCases := []struct {
+		currentPage page
+		total       int
+		wantStart   int
+		wantEnd     int
+		wantCursor  bool
+	}{
+		{page{}, 0, 0, 0, false},
+		{page{}, 5, 0, 5, false},
+		{page{limit: 2}, 5, 0, 2, true},
+		{page{offset: 2, limit: 2}, 5, 2, 4, true},
+		{page{offset: 3, limit: 2}, 5, 3, 5, false},
+		{page{offset: 10, limit: 2}, 5, 5, 5, false},
+		{page{offset: 1, limit: math.MaxInt64}, 5, 1, 5, false},
+		{page{offset: math.MaxInt64, limit: math.MaxInt64}, 5, 5, 5, false},
+	}
+
+	for _, testCase := range testCases {
+
+		start, end, cursor := testCase.currentPage.bounds(testCase.total)
+
+		if start != testCase.wantStart || end != testCase.wantEnd || (cursor != "") != testCase.wantCursor {
+			t.Errorf("%+v of %d: bounds = %d, %d, %q", testCase.currentPage, testCase.total, start, end, cursor)
+		}
+
+		if start < 0 || end < start || end > testCase.total {
+			t.Errorf("%+v of %d: bounds %d, %d are out of range", testCase.currentPage, testCase.total, start, end)
+		}
+
+		if cursor != "" {
+
+			offset, ok := decodeCursor(cursor)
+
+			if !ok || offset != end {
+				t.Errorf("%+v of %d: cursor %q decodes to %d", testCase.currentPage, testCase.total, cursor, offset)
+			}
+		}
+	}
+}
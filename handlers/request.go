@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"github.com/json-iterator/go"
+	"hlcup_epoll/entities"
+	"hlcup_epoll/services"
+	"mime"
+	"net/http"
+)
+
+func decodeEntityMap(request *http.Request) (map[string]interface{}, bool) {
+
+	entityMap := make(map[string]interface{})
+
+	err := jsoniter.NewDecoder(request.Body).Decode(&entityMap)
+
+	if err != nil {
+		return nil, false
+	}
+
+	return entityMap, true
+}
+
+// id may be omitted in PUT and PATCH bodies, but must not differ from the id in the path
+func isIdMatching(entityMap map[string]interface{}, entityId uint) bool {
+
+	value, ok := entityMap["id"]
+
+	if !ok {
+		return true
+	}
+
+	id, typeOk := value.(float64)
+
+	return typeOk && id == float64(entityId)
+}
+
+// RFC 7396 patches are sent as application/merge-patch+json, plain JSON is accepted as well
+func isMergePatch(request *http.Request) bool {
+
+	contentType := request.Header.Get("Content-Type")
+
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/merge-patch+json" || mediaType == "application/json"
+}
+
+func validationFailed(fieldErrors []*entities.FieldError) ([]byte, int) {
+
+	validationErrorsBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(&entities.ValidationErrors{Errors: fieldErrors})
+
+	if err != nil {
+		return nil, 400
+	}
+
+	return validationErrorsBytes, 400
+}
+
+func fieldFailed(field string, reason string) ([]byte, int) {
+
+	return validationFailed([]*entities.FieldError{{Field: field, Reason: reason}})
+}
+
+// parseFilterExpression compiles filter=..., a syntax error is answered with its position in the expression
+func parseFilterExpression(request *http.Request, filter *services.VisitsFilter) ([]byte, bool) {
+
+	value, ok := request.URL.Query()["filter"]
+
+	if !ok {
+		return nil, true
+	}
+
+	expression, err := services.CompileFilterExpression(string(value[0]))
+
+	if err != nil {
+		errorBytes, _ := fieldFailed("filter", err.Error())
+		return errorBytes, false
+	}
+
+	filter.Expression = expression
+	filter.Profile.AddFilter("filter", value[:1])
+
+	return nil, true
+}
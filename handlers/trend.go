@@ -0,0 +1,29 @@
+package handlers
+
+import "time"
+
+var trendBucketLayouts = map[string]string{
+	"day":   "2006-01-02",
+	"week":  "2006-01-02",
+	"month": "2006-01",
+	"year":  "2006",
+}
+
+// bucketStart returns the start of the day, week (from Monday), month or year containing visitedAt in the given timezone
+func bucketStart(visitedAt int64, bucket string, timezone *time.Location) time.Time {
+
+	visitTime := time.Unix(visitedAt, 0).In(timezone)
+
+	year, month, day := visitTime.Date()
+
+	switch bucket {
+	case "week":
+		return time.Date(year, month, day-(int(visitTime.Weekday())+6)%7, 0, 0, 0, 0, timezone)
+	case "month":
+		return time.Date(year, month, 1, 0, 0, 0, 0, timezone)
+	case "year":
+		return time.Date(year, time.January, 1, 0, 0, 0, 0, timezone)
+	default:
+		return time.Date(year, month, day, 0, 0, 0, 0, timezone)
+	}
+}
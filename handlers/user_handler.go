@@ -1,24 +1,30 @@
 package handlers
 
 import (
-	"hlcup_epoll/services"
-	"log"
-		"github.com/asaskevich/govalidator"
-	"strconv"
-	"time"
-	"os"
 	"bufio"
+	"bytes"
 	"encoding/json"
-		"github.com/json-iterator/go"
+	"github.com/json-iterator/go"
 	"hlcup_epoll/entities"
+	"hlcup_epoll/services"
+	"log"
+	"math"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 )
 
+var visitedPlacesSorts = []string{"visited_at", "mark", "distance", "place"}
+var visitedPlacesRelations = []string{"location"}
+var userComputedAttributes = []string{"age", "visit_count", "avg_mark_given", "last_visit_at"}
+
 type UserApiHandler struct {
 	storage            *services.Storage
 	errLogger          *log.Logger
 	infoLogger         *log.Logger
 	timeDataGeneration time.Time
+	filterRegistry     *services.FilterRegistry
 }
 
 func NewUserApiHandler(storage *services.Storage, errLogger *log.Logger, infoLogger *log.Logger, pathToOptions string) *UserApiHandler {
@@ -35,7 +41,13 @@ func NewUserApiHandler(storage *services.Storage, errLogger *log.Logger, infoLog
 		errLogger.Fatalln(err)
 	}
 
-	return &UserApiHandler{storage: storage, errLogger: errLogger, infoLogger: infoLogger, timeDataGeneration: time.Unix(int64(timeDataGeneration), 0)}
+	return &UserApiHandler{storage: storage, errLogger: errLogger, infoLogger: infoLogger, timeDataGeneration: time.Unix(int64(timeDataGeneration), 0), filterRegistry: services.NewFilterRegistry(services.UnknownParamsIgnore)}
+}
+
+// SetFilterRegistry sets the registry which parses the filters of the query parameters
+func (userApiHandler *UserApiHandler) SetFilterRegistry(filterRegistry *services.FilterRegistry) {
+
+	userApiHandler.filterRegistry = filterRegistry
 }
 
 func (userApiHandler *UserApiHandler) GetById(request *http.Request, userIdString string) ([]byte, int) {
@@ -50,95 +62,126 @@ func (userApiHandler *UserApiHandler) GetById(request *http.Request, userIdStrin
 		return nil, 404
 	}
 
+	include, ok := parseInclude(request, userComputedAttributes)
+
+	if !ok {
+		return nil, 400
+	}
+
 	user := userApiHandler.storage.GetUserById(uint(userId))
 
 	if user == nil {
 		return nil, 404
-	} else {
+	}
+
+	if len(include) == 0 {
 		return user, 200
 	}
+
+	return userApiHandler.withComputed(user, uint(userId), include)
 }
 
-func (userApiHandler *UserApiHandler) GetVisitedPlaces(request *http.Request, userIdString string) ([]byte, int) {
+// withComputed appends the included computed attributes to the stored user, visit totals come from the storage index
+func (userApiHandler *UserApiHandler) withComputed(userBytes []byte, userId uint, include map[string]bool) ([]byte, int) {
 
-	userId, err := strconv.Atoi(userIdString)
+	userComputed := new(entities.UserComputed)
 
-	if err != nil {
-		return nil, 404
-	}
+	if include["age"] {
 
-	if userId <= 0 {
-		return nil, 404
-	}
+		user := new(entities.User)
 
-	filter := services.InitVisitFilter(userApiHandler.timeDataGeneration)
+		err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(userBytes, user)
 
-	userIdUint := uint(userId)
+		if err != nil {
+			userApiHandler.errLogger.Fatalln(err)
+		}
 
-	filter.UserId = &userIdUint
+		age := services.AgeAt(*user.BirthDate, userApiHandler.timeDataGeneration)
 
-	if value, ok := request.URL.Query()["fromDate"]; ok {
+		userComputed.Age = &age
+	}
 
-		fromDateString := string(value[0])
+	if include["visit_count"] || include["avg_mark_given"] || include["last_visit_at"] {
 
-		if !govalidator.IsNumeric(fromDateString) || fromDateString == "" {
-			return nil, 400
-		}
+		visitStats := userApiHandler.storage.GetVisitStatsByUser(userId)
 
-		fromDateInt, err := strconv.Atoi(fromDateString)
+		avgMarkGiven := float64(0)
 
-		if err != nil {
-			userApiHandler.errLogger.Println(err)
+		if visitStats.Count != 0 {
+			avgMarkGiven = math.Round(float64(visitStats.SumOfMarks)/float64(visitStats.Count)*100000) / 100000
 		}
 
-		filter.FromDate = &fromDateInt
+		userComputed.VisitCount = &visitStats.Count
+		userComputed.AvgMarkGiven = &avgMarkGiven
+		userComputed.LastVisitAt = visitStats.LastVisitAt
 	}
 
-	if value, ok := request.URL.Query()["toDate"]; ok {
+	userComputedBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(userComputed)
 
-		toDateString := string(value[0])
-
-		if !govalidator.IsNumeric(toDateString) || toDateString == "" {
-			return nil, 400
-		}
+	if err != nil {
+		userApiHandler.errLogger.Fatalln(err)
+	}
 
-		toDateInt, err := strconv.Atoi(toDateString)
+	userComputedMap := make(map[string]json.RawMessage)
 
-		if err != nil {
-			userApiHandler.errLogger.Println(err)
-		}
+	err = json.Unmarshal(userComputedBytes, &userComputedMap)
 
-		filter.ToDate = &toDateInt
+	if err != nil {
+		userApiHandler.errLogger.Fatalln(err)
 	}
 
-	if value, ok := request.URL.Query()["toDistance"]; ok {
+	includedAttributes := make([]string, 0, len(include))
 
-		toDistanceString := string(value[0])
+	for _, attribute := range userComputedAttributes {
 
-		if !govalidator.IsNumeric(toDistanceString) || toDistanceString == "" {
-			return nil, 400
+		if include[attribute] {
+			includedAttributes = append(includedAttributes, attribute)
 		}
+	}
 
-		toDistanceInt, err := strconv.Atoi(toDistanceString)
+	includedBytes, _ := projectObject(userComputedBytes, userComputedMap, includedAttributes)
 
-		if err != nil {
-			userApiHandler.errLogger.Println(err)
-		}
+	userBytes = bytes.TrimRight(userBytes, " \r\n")
+
+	responseBytes := make([]byte, 0, len(userBytes)+len(includedBytes))
 
-		toDistanceUint := uint(toDistanceInt)
+	responseBytes = append(responseBytes, userBytes[:len(userBytes)-1]...)
+	responseBytes = append(responseBytes, ',')
+	responseBytes = append(responseBytes, includedBytes[1:]...)
+
+	return responseBytes, 200
+}
 
-		filter.ToDistance = &toDistanceUint
+func (userApiHandler *UserApiHandler) GetVisitedPlaces(request *http.Request, userIdString string) ([]byte, int) {
+
+	filter, errorBytes, code := userApiHandler.parseUserVisitsFilter(request, userIdString)
+
+	if code != 200 {
+		return errorBytes, code
 	}
 
-	if value, ok := request.URL.Query()["country"]; ok {
+	currentPage, ok := parsePage(request)
 
-		country := string(value[0])
+	if !ok {
+		return nil, 400
+	}
 
-		if country == "" || len(country) > 50 {
-			return nil, 400
-		}
+	sortBy, descending, ok := parseSort(request, visitedPlacesSorts)
 
-		filter.Country = &country
+	if !ok {
+		return nil, 400
+	}
+
+	expand, ok := parseExpand(request, visitedPlacesRelations)
+
+	if !ok {
+		return nil, 400
+	}
+
+	fields, ok := parseFields(request)
+
+	if !ok {
+		return nil, 400
 	}
 
 	visitedPlaceCollection := userApiHandler.storage.GetVisitedPlacesByUser(filter)
@@ -147,6 +190,26 @@ func (userApiHandler *UserApiHandler) GetVisitedPlaces(request *http.Request, us
 		return nil, 404
 	}
 
+	if sortBy != "" || descending {
+		visitedPlaceCollection.SortBy(sortBy, descending)
+	}
+
+	start, end, next := currentPage.bounds(len(visitedPlaceCollection.VisitedPlaces))
+
+	visitedPlaceCollection.VisitedPlaces = visitedPlaceCollection.VisitedPlaces[start:end]
+	visitedPlaceCollection.Next = next
+
+	if expand["location"] {
+
+		for _, visitedPlace := range visitedPlaceCollection.VisitedPlaces {
+			visitedPlace.LocationEntity = userApiHandler.storage.GetLocationById(visitedPlace.Location)
+		}
+	}
+
+	for _, visitedPlace := range visitedPlaceCollection.VisitedPlaces {
+		visitedPlace.Compute(fields)
+	}
+
 	visitedPlaceCollectionBytes, err := json.Marshal(visitedPlaceCollection)
 
 	if err != nil {
@@ -156,211 +219,354 @@ func (userApiHandler *UserApiHandler) GetVisitedPlaces(request *http.Request, us
 	return visitedPlaceCollectionBytes, 200
 }
 
-func (userApiHandler *UserApiHandler) Update(request *http.Request, userIdString string) ([]byte, int) {
+func (userApiHandler *UserApiHandler) GetAverageMark(request *http.Request, userIdString string) ([]byte, int) {
 
-	userId, err := strconv.Atoi(userIdString)
+	userStats, errorBytes, code := userApiHandler.collectStats(request, userIdString)
 
-	if err != nil {
-		return nil, 404
+	if code != 200 {
+		return errorBytes, code
 	}
 
-	userBytes := userApiHandler.storage.GetUserById(uint(userId))
+	userAvgMarkBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(&entities.UserAvgMark{Avg: userStats.Avg})
 
-	if userBytes == nil {
-		return nil, 404
+	if err != nil {
+		userApiHandler.errLogger.Fatalln(err)
 	}
 
-	newUserMap := make(map[string]interface{})
+	return userAvgMarkBytes, 200
+}
 
-	err = jsoniter.NewDecoder(request.Body).Decode(&newUserMap)
+func (userApiHandler *UserApiHandler) GetStats(request *http.Request, userIdString string) ([]byte, int) {
 
-	if err != nil {
-		return nil, 400
-	}
+	userStats, errorBytes, code := userApiHandler.collectStats(request, userIdString)
 
-	user := new(entities.User)
+	if code != 200 {
+		return errorBytes, code
+	}
 
-	err = jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(userBytes, user)
+	userStatsBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(userStats)
 
 	if err != nil {
 		userApiHandler.errLogger.Fatalln(err)
 	}
 
-	if value, ok := newUserMap["email"]; ok {
+	return userStatsBytes, 200
+}
 
-		email, typeOk := value.(string)
+func (userApiHandler *UserApiHandler) collectStats(request *http.Request, userIdString string) (*entities.UserStats, []byte, int) {
 
-		if value == nil || !typeOk || len(email) > 100 {
-			return nil, 400
-		}
+	filter, errorBytes, code := userApiHandler.parseUserVisitsFilter(request, userIdString)
 
-		user.Email = &email
+	if code != 200 {
+		return nil, errorBytes, code
 	}
 
-	if value, ok := newUserMap["first_name"]; ok {
+	visitedPlaceCollection := userApiHandler.storage.GetVisitedPlacesByUser(filter)
 
-		firstName, typeOk := value.(string)
+	if visitedPlaceCollection == nil {
+		return nil, nil, 404
+	}
 
-		if value == nil || !typeOk || len(firstName) > 50 {
-			return nil, 400
-		}
+	endAggregate := filter.Profile.Phase("aggregate")
 
-		user.FirstName = &firstName
-	}
+	userStats := new(entities.UserStats)
+	locations := make(map[uint]bool)
+	countries := make(map[string]bool)
+	sumOfMarks := 0
 
-	if value, ok := newUserMap["last_name"]; ok {
+	for _, visitedPlace := range visitedPlaceCollection.VisitedPlaces {
 
-		lastName, typeOk := value.(string)
+		locations[visitedPlace.Location] = true
+		countries[visitedPlace.Country] = true
+		sumOfMarks += visitedPlace.Mark
+		userStats.TotalDistance += visitedPlace.Distance
+	}
 
-		if value == nil || !typeOk || len(lastName) > 50 {
-			return nil, 400
-		}
+	userStats.Count = len(visitedPlaceCollection.VisitedPlaces)
+	userStats.Locations = len(locations)
+	userStats.Countries = len(countries)
 
-		user.LastName = &lastName
+	if userStats.Count != 0 {
+		userStats.Avg = math.Round(float64(sumOfMarks)/float64(userStats.Count)*100000) / 100000
 	}
 
-	if value, ok := newUserMap["gender"]; ok {
+	endAggregate()
+
+	return userStats, nil, 200
+}
 
-		gender, typeOk := value.(string)
+// parseUserVisitsFilter reads the filters shared by the visited places and the user aggregates
+func (userApiHandler *UserApiHandler) parseUserVisitsFilter(request *http.Request, userIdString string) (*services.VisitsFilter, []byte, int) {
 
-		if value == nil || !typeOk || (gender != "m" && gender != "f") {
-			return nil, 400
-		}
+	userId, err := strconv.Atoi(userIdString)
+
+	if err != nil {
+		return nil, nil, 404
+	}
 
-		user.Gender = &gender
+	if userId <= 0 {
+		return nil, nil, 404
 	}
 
-	if value, ok := newUserMap["birth_date"]; ok {
+	filter := services.InitVisitFilter(userApiHandler.timeDataGeneration)
 
-		birthDateFloat, typeOk := value.(float64)
+	filter.Profile = services.QueryProfileFrom(request.Context())
+	filter.Profile.Attach()
 
-		if value == nil || !typeOk {
-			return nil, 400
-		}
+	userIdUint := uint(userId)
 
-		birthDate := int(birthDateFloat)
+	filter.UserId = &userIdUint
 
-		user.BirthDate = &birthDate
+	if fieldErrors := userApiHandler.filterRegistry.Parse(request.URL.Query(), services.ScopeUserVisits, filter); len(fieldErrors) != 0 {
+		errorBytes, code := validationFailed(fieldErrors)
+		return nil, errorBytes, code
 	}
 
-	userApiHandler.storage.AddUser(user)
+	if errorBytes, ok := parseFilterExpression(request, filter); !ok {
+		return nil, errorBytes, 400
+	}
 
-	return []byte("{}"), 200
+	return filter, nil, 200
 }
 
-func (userApiHandler *UserApiHandler) Create(request *http.Request) ([]byte, int) {
-
-	newUserMap := make(map[string]interface{})
+func (userApiHandler *UserApiHandler) Update(request *http.Request, userIdString string) ([]byte, int) {
 
-	err := jsoniter.NewDecoder(request.Body).Decode(&newUserMap)
+	userId, err := strconv.Atoi(userIdString)
 
 	if err != nil {
-		return nil, 400
+		return nil, 404
 	}
 
-	userIdInterface, ok := newUserMap["id"]
+	userBytes := userApiHandler.storage.GetUserById(uint(userId))
+
+	if userBytes == nil {
+		return nil, 404
+	}
+
+	newUserMap, ok := decodeEntityMap(request)
 
 	if !ok {
 		return nil, 400
 	}
 
-	userIdFloat, typeOk := userIdInterface.(float64)
+	return userApiHandler.merge(userBytes, newUserMap)
+}
+
+func (userApiHandler *UserApiHandler) Patch(request *http.Request, userIdString string) ([]byte, int) {
 
-	if !typeOk {
-		return nil, 400
+	userId, err := strconv.Atoi(userIdString)
+
+	if err != nil {
+		return nil, 404
 	}
 
-	userIdUint := uint(userIdFloat)
+	userBytes := userApiHandler.storage.GetUserById(uint(userId))
 
-	userBytes := userApiHandler.storage.GetLocationById(userIdUint)
+	if userBytes == nil {
+		return nil, 404
+	}
 
-	if userBytes != nil {
+	if !isMergePatch(request) {
 		return nil, 400
 	}
 
-	emailInterface, ok := newUserMap["email"]
+	newUserMap, ok := decodeEntityMap(request)
 
 	if !ok {
 		return nil, 400
 	}
 
-	email, typeOk := emailInterface.(string)
+	if !isIdMatching(newUserMap, uint(userId)) {
+		return fieldFailed("id", "does not match the id in the path")
+	}
 
-	if !typeOk || len(email) > 100 {
-		return nil, 400
+	return userApiHandler.merge(userBytes, newUserMap)
+}
+
+func (userApiHandler *UserApiHandler) Replace(request *http.Request, userIdString string) ([]byte, int) {
+
+	userId, err := strconv.Atoi(userIdString)
+
+	if err != nil {
+		return nil, 404
 	}
 
-	isEmailExist := userApiHandler.storage.IsEmailExist(email)
+	userBytes := userApiHandler.storage.GetUserById(uint(userId))
 
-	if isEmailExist {
-		return nil, 400
+	if userBytes == nil {
+		return nil, 404
 	}
 
-	firstNameInterface, ok := newUserMap["first_name"]
+	newUserMap, ok := decodeEntityMap(request)
 
 	if !ok {
 		return nil, 400
 	}
 
-	lastNameInterface, ok := newUserMap["last_name"]
+	if !isIdMatching(newUserMap, uint(userId)) {
+		return fieldFailed("id", "does not match the id in the path")
+	}
 
-	if !ok {
-		return nil, 400
+	fieldErrors := entities.UserRules.Validate(newUserMap, entities.ValidateReplace)
+
+	if len(fieldErrors) != 0 {
+		return validationFailed(fieldErrors)
 	}
 
-	genderInterface, ok := newUserMap["gender"]
+	oldUser := new(entities.User)
 
-	if !ok {
+	err = jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(userBytes, oldUser)
+
+	if err != nil {
+		userApiHandler.errLogger.Fatalln(err)
+	}
+
+	userIdUint := uint(userId)
+
+	user := &entities.User{Id: &userIdUint}
+
+	delete(newUserMap, "id")
+
+	err = entities.Apply(newUserMap, user)
+
+	if err != nil {
 		return nil, 400
 	}
 
-	birthDateInterface, ok := newUserMap["birth_date"]
+	return userApiHandler.save(user, *oldUser.Email)
+}
+
+func (userApiHandler *UserApiHandler) Create(request *http.Request) ([]byte, int) {
+
+	newUserMap, ok := decodeEntityMap(request)
 
 	if !ok {
 		return nil, 400
 	}
 
+	item, fieldErrors := userApiHandler.prepareUser(newUserMap, newBulkBatch())
+
+	if len(fieldErrors) == 0 {
+		fieldErrors = item.commit()
+	}
+
+	if len(fieldErrors) != 0 {
+		return validationFailed(fieldErrors)
+	}
+
+	return []byte("{}"), 200
+}
+
+func (userApiHandler *UserApiHandler) Bulk(request *http.Request) ([]byte, int) {
+
+	return runBulk(request, userApiHandler.prepareUser)
+}
+
+// prepareUser is the validation path shared by single and bulk creation
+func (userApiHandler *UserApiHandler) prepareUser(newUserMap map[string]interface{}, batch *bulkBatch) (*bulkItem, []*entities.FieldError) {
+
+	fieldErrors := entities.UserRules.Validate(newUserMap, entities.ValidateCreate)
+
+	if len(fieldErrors) != 0 {
+		return nil, fieldErrors
+	}
+
 	user := new(entities.User)
 
-	user.Id = &userIdUint
+	err := entities.Apply(newUserMap, user)
 
-	user.Email = &email
+	if err != nil {
+		return nil, []*entities.FieldError{{Field: "item", Reason: err.Error()}}
+	}
 
-	firstName, typeOk := firstNameInterface.(string)
+	if batch.ids[*user.Id] || userApiHandler.storage.GetUserById(*user.Id) != nil {
+		return nil, []*entities.FieldError{{Field: "id", Reason: "already exists"}}
+	}
 
-	if !typeOk || len(firstName) > 50 {
-		return nil, 400
+	if batch.emails[*user.Email] || userApiHandler.storage.IsEmailExist(*user.Email) {
+		return nil, []*entities.FieldError{{Field: "email", Reason: "already exists"}}
 	}
 
-	user.FirstName = &firstName
+	batch.ids[*user.Id] = true
+	batch.emails[*user.Email] = true
 
-	lastName, typeOk := lastNameInterface.(string)
+	commit := func() []*entities.FieldError {
 
-	if !typeOk || len(lastName) > 50 {
-		return nil, 400
+		userApiHandler.storage.AddUser(user)
+
+		return nil
 	}
 
-	user.LastName = &lastName
+	rollback := func() {
 
-	gender, typeOk := genderInterface.(string)
+		userApiHandler.storage.DeleteUser(*user.Id)
+	}
 
-	if !typeOk || (gender != "m" && gender != "f") {
-		return nil, 400
+	return &bulkItem{id: *user.Id, commit: commit, rollback: rollback}, nil
+}
+
+func (userApiHandler *UserApiHandler) merge(userBytes []byte, newUserMap map[string]interface{}) ([]byte, int) {
+
+	fieldErrors := entities.UserRules.Validate(newUserMap, entities.ValidatePatch)
+
+	if len(fieldErrors) != 0 {
+		return validationFailed(fieldErrors)
 	}
 
-	user.Gender = &gender
+	user := new(entities.User)
+
+	err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(userBytes, user)
 
-	birthDateFloat, typeOk := birthDateInterface.(float64)
+	if err != nil {
+		userApiHandler.errLogger.Fatalln(err)
+	}
 
-	if !typeOk {
+	oldEmail := *user.Email
+
+	delete(newUserMap, "id")
+
+	err = entities.Apply(newUserMap, user)
+
+	if err != nil {
 		return nil, 400
 	}
 
-	birthDate := int(birthDateFloat)
+	return userApiHandler.save(user, oldEmail)
+}
+
+func (userApiHandler *UserApiHandler) save(user *entities.User, oldEmail string) ([]byte, int) {
 
-	user.BirthDate = &birthDate
+	if *user.Email != oldEmail {
+
+		if userApiHandler.storage.IsEmailExist(*user.Email) {
+			return fieldFailed("email", "already exists")
+		}
+
+		userApiHandler.storage.DeleteEmail(oldEmail)
+	}
 
 	userApiHandler.storage.AddUser(user)
 
 	return []byte("{}"), 200
-}
\ No newline at end of file
+}
+
+func (userApiHandler *UserApiHandler) Delete(request *http.Request, userIdString string) ([]byte, int) {
+
+	userId, err := strconv.Atoi(userIdString)
+
+	if err != nil {
+		return nil, 404
+	}
+
+	err = userApiHandler.storage.DeleteUser(uint(userId))
+
+	if err == services.ErrEntityNotFound {
+		return nil, 404
+	}
+
+	if err != nil {
+		return nil, 400
+	}
+
+	return []byte("{}"), 200
+}
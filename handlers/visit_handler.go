@@ -1,22 +1,23 @@
 package handlers
 
 import (
-	"hlcup_epoll/services"
-	"log"
-	"strconv"
+	"encoding/json"
 	"github.com/json-iterator/go"
 	"hlcup_epoll/entities"
+	"hlcup_epoll/services"
+	"log"
 	"net/http"
+	"strconv"
 )
 
+var visitRelations = []string{"user", "location"}
+
 type VisitApiHandler struct {
 	storage    *services.Storage
 	errLogger  *log.Logger
 	infoLogger *log.Logger
 }
 
-var oldLocationId, oldUserId uint
-
 func NewVisitApiHandler(storage *services.Storage, errLogger *log.Logger, infoLogger *log.Logger) *VisitApiHandler {
 
 	return &VisitApiHandler{storage: storage, errLogger: errLogger, infoLogger: infoLogger}
@@ -30,13 +31,65 @@ func (visitApiHandler *VisitApiHandler) GetById(request *http.Request, visitIdSt
 		return nil, 404
 	}
 
+	expand, ok := parseExpand(request, visitRelations)
+
+	if !ok {
+		return nil, 400
+	}
+
 	visit := visitApiHandler.storage.GetVisitById(uint(visitId))
 
 	if visit == nil {
 		return nil, 404
-	} else {
+	}
+
+	if len(expand) == 0 {
 		return visit, 200
 	}
+
+	return visitApiHandler.expand(visit, expand)
+}
+
+// expand inlines the stored user and location of a visit, a dangling reference keeps its id
+func (visitApiHandler *VisitApiHandler) expand(visitBytes []byte, expand map[string]bool) ([]byte, int) {
+
+	visit := new(entities.Visit)
+
+	err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(visitBytes, visit)
+
+	if err != nil {
+		visitApiHandler.errLogger.Fatalln(err)
+	}
+
+	expandedVisit := &entities.ExpandedVisit{
+		Id:        visit.Id,
+		Location:  json.RawMessage(strconv.FormatUint(uint64(*visit.Location), 10)),
+		User:      json.RawMessage(strconv.FormatUint(uint64(*visit.User), 10)),
+		VisitedAt: visit.VisitedAt,
+		Mark:      visit.Mark,
+	}
+
+	if expand["user"] {
+
+		if userBytes := visitApiHandler.storage.GetUserById(*visit.User); userBytes != nil {
+			expandedVisit.User = userBytes
+		}
+	}
+
+	if expand["location"] {
+
+		if locationBytes := visitApiHandler.storage.GetLocationById(*visit.Location); locationBytes != nil {
+			expandedVisit.Location = locationBytes
+		}
+	}
+
+	expandedVisitBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(expandedVisit)
+
+	if err != nil {
+		visitApiHandler.errLogger.Fatalln(err)
+	}
+
+	return expandedVisitBytes, 200
 }
 
 func (visitApiHandler *VisitApiHandler) Update(request *http.Request, visitIdString string) ([]byte, int) {
@@ -53,204 +106,231 @@ func (visitApiHandler *VisitApiHandler) Update(request *http.Request, visitIdStr
 		return nil, 404
 	}
 
-	newVisitMap := make(map[string]interface{})
+	newVisitMap, ok := decodeEntityMap(request)
 
-	err = jsoniter.NewDecoder(request.Body).Decode(&newVisitMap)
-
-	if err != nil {
+	if !ok {
 		return nil, 400
 	}
 
-	visit := new(entities.Visit)
+	return visitApiHandler.merge(visitBytes, newVisitMap)
+}
+
+func (visitApiHandler *VisitApiHandler) Patch(request *http.Request, visitIdString string) ([]byte, int) {
 
-	err = jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(visitBytes, visit)
+	visitId, err := strconv.Atoi(visitIdString)
 
 	if err != nil {
-		visitApiHandler.errLogger.Fatalln(err)
+		return nil, 404
 	}
 
-	if value, ok := newVisitMap["location"]; ok {
+	visitBytes := visitApiHandler.storage.GetVisitById(uint(visitId))
 
-		locationId, typeOk := value.(float64)
+	if visitBytes == nil {
+		return nil, 404
+	}
 
-		if value == nil || !typeOk || locationId <= 0 {
-			return nil, 400
-		}
+	if !isMergePatch(request) {
+		return nil, 400
+	}
 
-		locationIdAsUint := uint(locationId)
+	newVisitMap, ok := decodeEntityMap(request)
 
-		oldLocationId = *visit.Location
-		visit.Location = &locationIdAsUint
+	if !ok {
+		return nil, 400
 	}
 
-	if value, ok := newVisitMap["user"]; ok {
+	if !isIdMatching(newVisitMap, uint(visitId)) {
+		return fieldFailed("id", "does not match the id in the path")
+	}
 
-		userId, typeOk := value.(float64)
+	return visitApiHandler.merge(visitBytes, newVisitMap)
+}
 
-		if value == nil || !typeOk || userId <= 0 {
-			return nil, 400
-		}
+func (visitApiHandler *VisitApiHandler) Replace(request *http.Request, visitIdString string) ([]byte, int) {
 
-		userIdAsUint := uint(userId)
+	visitId, err := strconv.Atoi(visitIdString)
 
-		oldUserId = *visit.User
-		visit.User = &userIdAsUint
+	if err != nil {
+		return nil, 404
 	}
 
-	if value, ok := newVisitMap["visited_at"]; ok {
+	visitBytes := visitApiHandler.storage.GetVisitById(uint(visitId))
 
-		visitedAt, typeOk := value.(float64)
+	if visitBytes == nil {
+		return nil, 404
+	}
 
-		if value == nil || !typeOk {
-			return nil, 400
-		}
+	newVisitMap, ok := decodeEntityMap(request)
 
-		visitedAtAsInt := int(visitedAt)
+	if !ok {
+		return nil, 400
+	}
 
-		visit.VisitedAt = &visitedAtAsInt
+	if !isIdMatching(newVisitMap, uint(visitId)) {
+		return fieldFailed("id", "does not match the id in the path")
 	}
 
-	if value, ok := newVisitMap["mark"]; ok {
+	fieldErrors := entities.VisitRules.Validate(newVisitMap, entities.ValidateReplace)
 
-		mark, typeOk := value.(float64)
+	if len(fieldErrors) != 0 {
+		return validationFailed(fieldErrors)
+	}
 
-		if value == nil || !typeOk || (mark != 0 && mark != 1 && mark != 2 && mark != 3 && mark != 4 && mark != 5) {
-			return nil, 400
-		}
+	visitIdUint := uint(visitId)
 
-		markAsInt := int(mark)
+	visit := &entities.Visit{Id: &visitIdUint}
 
-		visit.Mark = &markAsInt
-	}
+	delete(newVisitMap, "id")
 
-	if _, ok := newVisitMap["location"]; ok {
-		visitApiHandler.storage.DeleteVisitFromLocation(oldLocationId, *visit.Id)
-		visitApiHandler.storage.AddVisitByLocationId(visit)
-	}
+	err = entities.Apply(newVisitMap, visit)
 
-	if _, ok := newVisitMap["user"]; ok {
-		visitApiHandler.storage.DeleteVisitFromUser(oldUserId, *visit.Id)
-		visitApiHandler.storage.AddVisitByUserId(visit)
+	if err != nil {
+		return nil, 400
 	}
 
-	visitApiHandler.storage.AddVisit(visit)
-
-	return []byte("{}"), 200
+	return visitApiHandler.saved(visitApiHandler.storage.UpdateVisit(visit))
 }
 
 func (visitApiHandler *VisitApiHandler) Create(request *http.Request) ([]byte, int) {
 
-	newVisitMap := make(map[string]interface{})
-
-	err := jsoniter.NewDecoder(request.Body).Decode(&newVisitMap)
+	newVisitMap, ok := decodeEntityMap(request)
 
-	if err != nil {
+	if !ok {
 		return nil, 400
 	}
 
-	visitIdInterface, ok := newVisitMap["id"]
+	item, fieldErrors := visitApiHandler.prepareVisit(newVisitMap, newBulkBatch())
 
-	if !ok {
-		return nil, 400
+	if len(fieldErrors) == 0 {
+		fieldErrors = item.commit()
 	}
 
-	visitIdFloat, typeOk := visitIdInterface.(float64)
-
-	if !typeOk {
-		return nil, 400
+	if len(fieldErrors) != 0 {
+		return validationFailed(fieldErrors)
 	}
 
-	visitIdUint := uint(visitIdFloat)
+	return []byte("{}"), 200
+}
 
-	visitBytes := visitApiHandler.storage.GetVisitById(visitIdUint)
+func (visitApiHandler *VisitApiHandler) Bulk(request *http.Request) ([]byte, int) {
 
-	if visitBytes != nil {
-		return nil, 400
-	}
+	return runBulk(request, visitApiHandler.prepareVisit)
+}
 
-	locationIdInterface, ok := newVisitMap["location"]
+// prepareVisit is the validation path shared by single and bulk creation
+func (visitApiHandler *VisitApiHandler) prepareVisit(newVisitMap map[string]interface{}, batch *bulkBatch) (*bulkItem, []*entities.FieldError) {
 
-	if !ok {
-		return nil, 400
+	fieldErrors := entities.VisitRules.Validate(newVisitMap, entities.ValidateCreate)
+
+	if len(fieldErrors) != 0 {
+		return nil, fieldErrors
 	}
 
-	userIdInterface, ok := newVisitMap["user"]
+	visit := new(entities.Visit)
 
-	if !ok {
-		return nil, 400
-	}
+	err := entities.Apply(newVisitMap, visit)
 
-	VisitedAtInterface, ok := newVisitMap["visited_at"]
+	if err != nil {
+		return nil, []*entities.FieldError{{Field: "item", Reason: err.Error()}}
+	}
 
-	if !ok {
-		return nil, 400
+	if batch.ids[*visit.Id] || visitApiHandler.storage.GetVisitById(*visit.Id) != nil {
+		return nil, []*entities.FieldError{{Field: "id", Reason: "already exists"}}
 	}
 
-	markInterface, ok := newVisitMap["mark"]
+	if visitApiHandler.storage.GetUserById(*visit.User) == nil {
+		return nil, visitFieldErrors(services.ErrUnknownUser)
+	}
 
-	if !ok {
-		return nil, 400
+	if visitApiHandler.storage.GetLocationById(*visit.Location) == nil {
+		return nil, visitFieldErrors(services.ErrUnknownLocation)
 	}
 
-	visit := new(entities.Visit)
+	batch.ids[*visit.Id] = true
 
-	visit.Id = &visitIdUint
+	commit := func() []*entities.FieldError {
 
-	locationIdFloat, typeOk := locationIdInterface.(float64)
+		return visitFieldErrors(visitApiHandler.storage.CreateVisit(visit))
+	}
 
-	if !typeOk || locationIdFloat <= 0 {
-		return nil, 400
+	rollback := func() {
+
+		visitApiHandler.storage.DeleteVisit(*visit.Id)
 	}
 
-	locationIdUint := uint(locationIdFloat)
+	return &bulkItem{id: *visit.Id, commit: commit, rollback: rollback}, nil
+}
+
+func (visitApiHandler *VisitApiHandler) merge(visitBytes []byte, newVisitMap map[string]interface{}) ([]byte, int) {
 
-	location := visitApiHandler.storage.GetLocationById(locationIdUint)
+	fieldErrors := entities.VisitRules.Validate(newVisitMap, entities.ValidatePatch)
 
-	if location == nil {
-		return nil, 400
+	if len(fieldErrors) != 0 {
+		return validationFailed(fieldErrors)
 	}
 
-	visit.Location = &locationIdUint
+	visit := new(entities.Visit)
 
-	userIdFloat, typeOk := userIdInterface.(float64)
+	err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(visitBytes, visit)
 
-	if !typeOk || userIdFloat <= 0 {
-		return nil, 400
+	if err != nil {
+		visitApiHandler.errLogger.Fatalln(err)
 	}
 
-	userIdUint := uint(userIdFloat)
+	delete(newVisitMap, "id")
 
-	user := visitApiHandler.storage.GetUserById(userIdUint)
+	err = entities.Apply(newVisitMap, visit)
 
-	if user == nil {
+	if err != nil {
 		return nil, 400
 	}
 
-	visit.User = &userIdUint
+	return visitApiHandler.saved(visitApiHandler.storage.UpdateVisit(visit))
+}
 
-	visitedAtFloat, typeOk := VisitedAtInterface.(float64)
+func (visitApiHandler *VisitApiHandler) saved(err error) ([]byte, int) {
 
-	if !typeOk {
-		return nil, 400
+	switch err {
+	case nil:
+		return []byte("{}"), 200
+	case services.ErrEntityNotFound:
+		return nil, 404
+	default:
+		return validationFailed(visitFieldErrors(err))
 	}
+}
 
-	visitedAtInt := int(visitedAtFloat)
+func visitFieldErrors(err error) []*entities.FieldError {
+
+	switch err {
+	case nil:
+		return nil
+	case services.ErrUnknownUser:
+		return []*entities.FieldError{{Field: "user", Reason: "does not exist"}}
+	case services.ErrUnknownLocation:
+		return []*entities.FieldError{{Field: "location", Reason: "does not exist"}}
+	default:
+		return []*entities.FieldError{{Field: "item", Reason: err.Error()}}
+	}
+}
 
-	visit.VisitedAt = &visitedAtInt
+func (visitApiHandler *VisitApiHandler) Delete(request *http.Request, visitIdString string) ([]byte, int) {
 
-	markFloat, typeOk := markInterface.(float64)
+	visitId, err := strconv.Atoi(visitIdString)
 
-	if !typeOk || (markFloat != 0 && markFloat != 1 && markFloat != 2 && markFloat != 3 && markFloat != 4 && markFloat != 5) {
-		return nil, 400
+	if err != nil {
+		return nil, 404
 	}
 
-	markInt := int(markFloat)
+	err = visitApiHandler.storage.DeleteVisit(uint(visitId))
 
-	visit.Mark = &markInt
+	if err == services.ErrEntityNotFound {
+		return nil, 404
+	}
 
-	visitApiHandler.storage.AddVisit(visit)
-	visitApiHandler.storage.AddVisitByUserId(visit)
-	visitApiHandler.storage.AddVisitByLocationId(visit)
+	if err != nil {
+		return nil, 400
+	}
 
 	return []byte("{}"), 200
 }
@@ -0,0 +1,86 @@
+package indexes
+
+import (
+	"sort"
+	"sync"
+)
+
+type LocationIndexByCity struct {
+	locations map[string][]uint
+	mutex     *sync.Mutex
+}
+
+func NewLocationIndexByCity() *LocationIndexByCity {
+	return &LocationIndexByCity{locations: make(map[string][]uint), mutex: new(sync.Mutex)}
+}
+
+func (locationIndexByCity *LocationIndexByCity) AddLocation(city string, locationId uint) {
+
+	locationIndexByCity.mutex.Lock()
+
+	locationIndexByCity.locations[city] = append(locationIndexByCity.locations[city], locationId)
+
+	locationIndexByCity.mutex.Unlock()
+}
+
+func (locationIndexByCity *LocationIndexByCity) GetLocations(city string) []uint {
+
+	locationIndexByCity.mutex.Lock()
+
+	locations := append([]uint(nil), locationIndexByCity.locations[city]...)
+
+	locationIndexByCity.mutex.Unlock()
+
+	return locations
+}
+
+func (locationIndexByCity *LocationIndexByCity) GetNames() []string {
+
+	locationIndexByCity.mutex.Lock()
+
+	names := make([]string, 0, len(locationIndexByCity.locations))
+
+	for name := range locationIndexByCity.locations {
+		names = append(names, name)
+	}
+
+	locationIndexByCity.mutex.Unlock()
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (locationIndexByCity *LocationIndexByCity) DeleteLocation(city string, locationId uint) {
+
+	locationIndexByCity.mutex.Lock()
+
+	locationsByCity := locationIndexByCity.locations[city]
+
+	for locationIndex, locationValue := range locationsByCity {
+
+		if locationValue == locationId {
+			locationsByCity = append(locationsByCity[:locationIndex], locationsByCity[locationIndex+1:]...)
+			break
+		}
+	}
+
+	if len(locationsByCity) == 0 {
+		delete(locationIndexByCity.locations, city)
+	} else {
+		locationIndexByCity.locations[city] = locationsByCity
+	}
+
+	locationIndexByCity.mutex.Unlock()
+}
+
+func (locationIndexByCity *LocationIndexByCity) Count() int {
+
+	locationIndexByCity.mutex.Lock()
+
+	count := len(locationIndexByCity.locations)
+
+	locationIndexByCity.mutex.Unlock()
+
+	return count
+}
@@ -0,0 +1,86 @@
+package indexes
+
+import (
+	"sort"
+	"sync"
+)
+
+type LocationIndexByCountry struct {
+	locations map[string][]uint
+	mutex     *sync.Mutex
+}
+
+func NewLocationIndexByCountry() *LocationIndexByCountry {
+	return &LocationIndexByCountry{locations: make(map[string][]uint), mutex: new(sync.Mutex)}
+}
+
+func (locationIndexByCountry *LocationIndexByCountry) AddLocation(country string, locationId uint) {
+
+	locationIndexByCountry.mutex.Lock()
+
+	locationIndexByCountry.locations[country] = append(locationIndexByCountry.locations[country], locationId)
+
+	locationIndexByCountry.mutex.Unlock()
+}
+
+func (locationIndexByCountry *LocationIndexByCountry) GetLocations(country string) []uint {
+
+	locationIndexByCountry.mutex.Lock()
+
+	locations := append([]uint(nil), locationIndexByCountry.locations[country]...)
+
+	locationIndexByCountry.mutex.Unlock()
+
+	return locations
+}
+
+func (locationIndexByCountry *LocationIndexByCountry) GetNames() []string {
+
+	locationIndexByCountry.mutex.Lock()
+
+	names := make([]string, 0, len(locationIndexByCountry.locations))
+
+	for name := range locationIndexByCountry.locations {
+		names = append(names, name)
+	}
+
+	locationIndexByCountry.mutex.Unlock()
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (locationIndexByCountry *LocationIndexByCountry) DeleteLocation(country string, locationId uint) {
+
+	locationIndexByCountry.mutex.Lock()
+
+	locationsByCountry := locationIndexByCountry.locations[country]
+
+	for locationIndex, locationValue := range locationsByCountry {
+
+		if locationValue == locationId {
+			locationsByCountry = append(locationsByCountry[:locationIndex], locationsByCountry[locationIndex+1:]...)
+			break
+		}
+	}
+
+	if len(locationsByCountry) == 0 {
+		delete(locationIndexByCountry.locations, country)
+	} else {
+		locationIndexByCountry.locations[country] = locationsByCountry
+	}
+
+	locationIndexByCountry.mutex.Unlock()
+}
+
+func (locationIndexByCountry *LocationIndexByCountry) Count() int {
+
+	locationIndexByCountry.mutex.Lock()
+
+	count := len(locationIndexByCountry.locations)
+
+	locationIndexByCountry.mutex.Unlock()
+
+	return count
+}
@@ -1,35 +1,51 @@
 package indexes
 
 import (
+	"github.com/json-iterator/go"
 	"hlcup_epoll/entities"
 	"sync"
-	"github.com/json-iterator/go"
 )
 
 type LocationIndexById struct {
 	locations map[uint][]byte
+	ids       *sortedIds
+	snapshots snapshotSet
 	mutex     *sync.Mutex
 }
 
 func NewLocationIndexById() *LocationIndexById {
-	return &LocationIndexById{locations: make(map[uint][]byte), mutex: new(sync.Mutex)}
+	return &LocationIndexById{
+		locations: make(map[uint][]byte),
+		ids:       newSortedIds(),
+		snapshots: make(snapshotSet),
+		mutex:     new(sync.Mutex),
+	}
 }
 
-func (locationIndexById *LocationIndexById) AddLocation(location *entities.Location) error {
+// AddLocation stores the location and returns the one it replaced, nil for a new id
+func (locationIndexById *LocationIndexById) AddLocation(location *entities.Location) ([]byte, error) {
 
 	encodedLocation, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(location)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	locationIndexById.mutex.Lock()
 
+	oldLocationBytes, isIdExist := locationIndexById.locations[*location.Id]
+
+	locationIndexById.snapshots.keep(*location.Id, oldLocationBytes)
+
 	locationIndexById.locations[*location.Id] = encodedLocation
 
+	if !isIdExist {
+		locationIndexById.ids.add(*location.Id)
+	}
+
 	locationIndexById.mutex.Unlock()
 
-	return nil
+	return oldLocationBytes, nil
 }
 
 func (locationIndexById *LocationIndexById) GetLocation(locationId uint) []byte {
@@ -42,3 +58,42 @@ func (locationIndexById *LocationIndexById) GetLocation(locationId uint) []byte
 
 	return locationBytes
 }
+
+func (locationIndexById *LocationIndexById) DeleteLocation(locationId uint) {
+
+	locationIndexById.mutex.Lock()
+
+	oldLocationBytes, isIdExist := locationIndexById.locations[locationId]
+
+	if isIdExist {
+		locationIndexById.snapshots.keep(locationId, oldLocationBytes)
+		locationIndexById.ids.remove(locationId)
+	}
+
+	delete(locationIndexById.locations, locationId)
+
+	locationIndexById.mutex.Unlock()
+}
+
+// Snapshot opens a point-in-time snapshot of the locations with ids in the inclusive range [fromId, toId]
+func (locationIndexById *LocationIndexById) Snapshot(fromId uint, toId uint) *Snapshot {
+
+	locationIndexById.mutex.Lock()
+
+	snapshot := newSnapshot(locationIndexById.locations, locationIndexById.ids, locationIndexById.mutex, locationIndexById.snapshots, fromId, toId)
+
+	locationIndexById.mutex.Unlock()
+
+	return snapshot
+}
+
+func (locationIndexById *LocationIndexById) Count() int {
+
+	locationIndexById.mutex.Lock()
+
+	count := len(locationIndexById.locations)
+
+	locationIndexById.mutex.Unlock()
+
+	return count
+}
@@ -0,0 +1,165 @@
+package indexes
+
+import (
+	"sort"
+	"sync"
+)
+
+const snapshotBatchSize = 256
+
+// Snapshot reads the encoded entities of an index in id order as they were when it was taken.
+// Nothing is copied up front: the ids are read from the sorted ids of the index one batch at a time as the stream
+// progresses, and until the snapshot is done the index keeps the previous value of every entity written ahead of it.
+// Stored entities are never modified in place, updates replace them, so a batch shares the bytes of the index.
+type Snapshot struct {
+	entities  map[uint][]byte
+	ids       *sortedIds
+	mutex     *sync.Mutex
+	snapshots snapshotSet
+	nextId    uint
+	toId      uint
+	isDone    bool
+	//previous holds the value before the first write of every id which is not read yet, nil if it did not exist
+	previous map[uint][]byte
+}
+
+// snapshotSet is the open snapshots of an index, it is changed under the mutex of the index
+type snapshotSet map[*Snapshot]bool
+
+// newSnapshot opens a snapshot of the ids in the inclusive range [fromId, toId], the caller holds the mutex
+func newSnapshot(entities map[uint][]byte, ids *sortedIds, mutex *sync.Mutex, snapshots snapshotSet, fromId uint, toId uint) *Snapshot {
+
+	snapshot := &Snapshot{
+		entities:  entities,
+		ids:       ids,
+		mutex:     mutex,
+		snapshots: snapshots,
+		nextId:    fromId,
+		toId:      toId,
+		isDone:    fromId > toId,
+		previous:  make(map[uint][]byte),
+	}
+
+	if !snapshot.isDone {
+		snapshots[snapshot] = true
+	}
+
+	return snapshot
+}
+
+// keep gives every open snapshot which has not read id yet the value id had before a write, the caller holds the mutex
+func (snapshots snapshotSet) keep(id uint, previousBytes []byte) {
+
+	for snapshot := range snapshots {
+
+		if id < snapshot.nextId || id > snapshot.toId {
+			continue
+		}
+
+		if _, isKept := snapshot.previous[id]; !isKept {
+			snapshot.previous[id] = previousBytes
+		}
+	}
+}
+
+// Next returns the ids and the entities of the next batch and whether there are more batches to read.
+// A batch may be empty while there are more, when all of its entities were created after the snapshot.
+func (snapshot *Snapshot) Next() ([]uint, [][]byte, bool) {
+
+	snapshot.mutex.Lock()
+
+	if snapshot.isDone {
+		snapshot.mutex.Unlock()
+		return nil, nil, false
+	}
+
+	ids := snapshot.ids.next(snapshot.nextId, snapshotBatchSize)
+
+	lastId := snapshot.toId
+	hasMore := false
+
+	if len(ids) == snapshotBatchSize && ids[len(ids)-1] < snapshot.toId {
+		lastId = ids[len(ids)-1]
+		hasMore = true
+	}
+
+	for len(ids) != 0 && ids[len(ids)-1] > lastId {
+		ids = ids[:len(ids)-1]
+	}
+
+	//the entities deleted after the snapshot was taken are not among the ids of the index anymore
+	isMerged := false
+
+	for id, previousBytes := range snapshot.previous {
+
+		if id > lastId {
+			continue
+		}
+
+		if _, isStored := snapshot.entities[id]; isStored {
+			continue
+		}
+
+		//created and deleted again after the snapshot was taken
+		if previousBytes == nil {
+			delete(snapshot.previous, id)
+			continue
+		}
+
+		ids = append(ids, id)
+		isMerged = true
+	}
+
+	if isMerged {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+
+	batchIds := make([]uint, 0, len(ids))
+	batchEntities := make([][]byte, 0, len(ids))
+
+	for _, id := range ids {
+
+		entityBytes, isKept := snapshot.previous[id]
+
+		if isKept {
+			delete(snapshot.previous, id)
+		} else {
+			entityBytes = snapshot.entities[id]
+		}
+
+		if entityBytes == nil {
+			continue
+		}
+
+		batchIds = append(batchIds, id)
+		batchEntities = append(batchEntities, entityBytes)
+	}
+
+	if hasMore {
+		snapshot.nextId = lastId + 1
+	} else {
+		snapshot.close()
+	}
+
+	snapshot.mutex.Unlock()
+
+	return batchIds, batchEntities, hasMore
+}
+
+// Close releases a snapshot which is not read to its end, the index stops keeping values for it
+func (snapshot *Snapshot) Close() {
+
+	snapshot.mutex.Lock()
+
+	snapshot.close()
+
+	snapshot.mutex.Unlock()
+}
+
+func (snapshot *Snapshot) close() {
+
+	snapshot.isDone = true
+	snapshot.previous = nil
+
+	delete(snapshot.snapshots, snapshot)
+}
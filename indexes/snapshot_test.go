@@ -0,0 +1,113 @@
+package indexes
+
+import (
+	"bytes"
+	"hlcup_epoll/entities"
+	"testing"
+)
+
+func newTestUser(id uint, firstName string) *entities.User {
+	return &entities.User{Id: &id, FirstName: &firstName}
+}
+
+func TestSnapshotPointInTime(t *testing.T) {
+
+	userIndex := NewUserIndexById()
+
+	for id := uint(1); id <= 600; id++ {
+		userIndex.AddUser(newTestUser(id, "before"))
+	}
+
+	snapshot := userIndex.Snapshot(1, 1000)
+
+	readIds, readUsers, hasMore := snapshot.Next()
+
+	if len(readIds) != snapshotBatchSize || readIds[0] != 1 || !hasMore {
+		t.Fatalf("first batch of %d ids from %v, more %v", len(readIds), readIds[:1], hasMore)
+	}
+
+	//the writes after the snapshot was taken are not seen by it, whether they are ahead of it or behind
+	userIndex.AddUser(newTestUser(10, "after"))
+	userIndex.AddUser(newTestUser(300, "after"))
+	userIndex.DeleteUser(400)
+	userIndex.AddUser(newTestUser(700, "after"))
+	userIndex.AddUser(newTestUser(800, "after"))
+	userIndex.DeleteUser(800)
+
+	for hasMore {
+
+		var batchIds []uint
+		var batchUsers [][]byte
+
+		batchIds, batchUsers, hasMore = snapshot.Next()
+
+		readIds = append(readIds, batchIds...)
+		readUsers = append(readUsers, batchUsers...)
+	}
+
+	if len(readIds) != 600 {
+		t.Fatalf("%d users read, want 600", len(readIds))
+	}
+
+	for index, id := range readIds {
+
+		if id != uint(index+1) {
+			t.Fatalf("user %d has id %d", index, id)
+		}
+
+		if !bytes.Contains(readUsers[index], []byte(`"before"`)) {
+			t.Errorf("user %d = %s, want the value before the snapshot", id, readUsers[index])
+		}
+	}
+
+	if len(userIndex.snapshots) != 0 {
+		t.Errorf("%d snapshots are still open after the last batch", len(userIndex.snapshots))
+	}
+
+	if userIndex.GetUser(400) != nil || userIndex.GetUser(700) == nil {
+		t.Errorf("the index lost the writes made during the snapshot")
+	}
+}
+
+func TestSnapshotRange(t *testing.T) {
+
+	userIndex := NewUserIndexById()
+
+	for _, id := range []uint{5, 1, 9, 3, 7} {
+		userIndex.AddUser(newTestUser(id, "user"))
+	}
+
+	readIds, _, hasMore := userIndex.Snapshot(2, 7).Next()
+
+	if hasMore || len(readIds) != 3 || readIds[0] != 3 || readIds[1] != 5 || readIds[2] != 7 {
+		t.Errorf("ids = %v, more %v, want [3 5 7]", readIds, hasMore)
+	}
+
+	if readIds, _, hasMore = userIndex.Snapshot(8, 2).Next(); len(readIds) != 0 || hasMore {
+		t.Errorf("an empty range read %v", readIds)
+	}
+}
+
+func TestSnapshotClose(t *testing.T) {
+
+	userIndex := NewUserIndexById()
+
+	for id := uint(1); id <= 600; id++ {
+		userIndex.AddUser(newTestUser(id, "user"))
+	}
+
+	snapshot := userIndex.Snapshot(1, 600)
+
+	snapshot.Next()
+	snapshot.Close()
+
+	userIndex.AddUser(newTestUser(500, "after"))
+
+	if len(userIndex.snapshots) != 0 || snapshot.previous != nil {
+		t.Errorf("a closed snapshot still keeps values")
+	}
+
+	if readIds, _, hasMore := snapshot.Next(); len(readIds) != 0 || hasMore {
+		t.Errorf("a closed snapshot read %d ids", len(readIds))
+	}
+}
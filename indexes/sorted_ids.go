@@ -0,0 +1,113 @@
+package indexes
+
+import "sort"
+
+const sortedIdsBlockSize = 512
+
+// sortedIds keeps the ids of an index in ascending order, split into blocks of at most 2*sortedIdsBlockSize ids.
+// An id is added or removed by moving the ids of one block, and the ids from any id on are read without sorting.
+type sortedIds struct {
+	blocks [][]uint
+}
+
+func newSortedIds() *sortedIds {
+	return &sortedIds{blocks: make([][]uint, 0)}
+}
+
+// blockOf returns the first block whose last id is not less than id, len(blocks) when there is none
+func (sortedIds *sortedIds) blockOf(id uint) int {
+
+	return sort.Search(len(sortedIds.blocks), func(blockIndex int) bool {
+
+		block := sortedIds.blocks[blockIndex]
+
+		return block[len(block)-1] >= id
+	})
+}
+
+func (sortedIds *sortedIds) add(id uint) {
+
+	if len(sortedIds.blocks) == 0 {
+		sortedIds.blocks = append(sortedIds.blocks, []uint{id})
+		return
+	}
+
+	blockIndex := sortedIds.blockOf(id)
+
+	//an id greater than every other one goes to the end of the last block
+	if blockIndex == len(sortedIds.blocks) {
+		blockIndex--
+	}
+
+	block := sortedIds.blocks[blockIndex]
+
+	position := sort.Search(len(block), func(index int) bool { return block[index] >= id })
+
+	if position < len(block) && block[position] == id {
+		return
+	}
+
+	block = append(block, 0)
+	copy(block[position+1:], block[position:])
+	block[position] = id
+
+	sortedIds.blocks[blockIndex] = block
+
+	if len(block) <= 2*sortedIdsBlockSize {
+		return
+	}
+
+	//the upper half gets its own array, so appending to the lower half never overwrites it
+	upperBlock := append(make([]uint, 0, 2*sortedIdsBlockSize), block[sortedIdsBlockSize:]...)
+
+	sortedIds.blocks[blockIndex] = block[:sortedIdsBlockSize]
+
+	sortedIds.blocks = append(sortedIds.blocks, nil)
+	copy(sortedIds.blocks[blockIndex+2:], sortedIds.blocks[blockIndex+1:])
+	sortedIds.blocks[blockIndex+1] = upperBlock
+}
+
+func (sortedIds *sortedIds) remove(id uint) {
+
+	blockIndex := sortedIds.blockOf(id)
+
+	if blockIndex == len(sortedIds.blocks) {
+		return
+	}
+
+	block := sortedIds.blocks[blockIndex]
+
+	position := sort.Search(len(block), func(index int) bool { return block[index] >= id })
+
+	if block[position] != id {
+		return
+	}
+
+	block = append(block[:position], block[position+1:]...)
+
+	if len(block) != 0 {
+		sortedIds.blocks[blockIndex] = block
+		return
+	}
+
+	sortedIds.blocks = append(sortedIds.blocks[:blockIndex], sortedIds.blocks[blockIndex+1:]...)
+}
+
+// next returns at most count ids which are not less than fromId, in ascending order
+func (sortedIds *sortedIds) next(fromId uint, count int) []uint {
+
+	ids := make([]uint, 0, count)
+
+	for blockIndex := sortedIds.blockOf(fromId); blockIndex < len(sortedIds.blocks) && len(ids) < count; blockIndex++ {
+
+		block := sortedIds.blocks[blockIndex]
+
+		position := sort.Search(len(block), func(index int) bool { return block[index] >= fromId })
+
+		for ; position < len(block) && len(ids) < count; position++ {
+			ids = append(ids, block[position])
+		}
+	}
+
+	return ids
+}
@@ -0,0 +1,67 @@
+package indexes
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSortedIds(t *testing.T) {
+
+	ids := newSortedIds()
+	expected := make(map[uint]bool)
+
+	random := rand.New(rand.NewSource(1))
+
+	for step := 0; step < 20000; step++ {
+
+		id := uint(random.Intn(5000))
+
+		if random.Intn(3) == 0 {
+			ids.remove(id)
+			delete(expected, id)
+		} else {
+			ids.add(id)
+			expected[id] = true
+		}
+	}
+
+	wantIds := make([]uint, 0, len(expected))
+
+	for id := range expected {
+		wantIds = append(wantIds, id)
+	}
+
+	sort.Slice(wantIds, func(i, j int) bool { return wantIds[i] < wantIds[j] })
+
+	gotIds := ids.next(0, len(wantIds)+1)
+
+	if len(gotIds) != len(wantIds) {
+		t.Fatalf("%d ids, want %d", len(gotIds), len(wantIds))
+	}
+
+	for index := range wantIds {
+
+		if gotIds[index] != wantIds[index] {
+			t.Fatalf("id %d = %d, want %d", index, gotIds[index], wantIds[index])
+		}
+	}
+
+	for _, block := range ids.blocks {
+
+		if len(block) == 0 || len(block) > 2*sortedIdsBlockSize {
+			t.Fatalf("block of %d ids", len(block))
+		}
+	}
+
+	fromId := wantIds[len(wantIds)/2] + 1
+	position := sort.Search(len(wantIds), func(index int) bool { return wantIds[index] >= fromId })
+
+	if gotIds = ids.next(fromId, 3); len(gotIds) != 3 || gotIds[0] != wantIds[position] || gotIds[2] != wantIds[position+2] {
+		t.Errorf("next(%d, 3) = %v, want from %d", fromId, gotIds, wantIds[position])
+	}
+
+	if gotIds = ids.next(wantIds[len(wantIds)-1]+1, 3); len(gotIds) != 0 {
+		t.Errorf("next after the last id = %v", gotIds)
+	}
+}
@@ -35,3 +35,14 @@ func (userIndexByEmail *UserIndexByEmail) DeleteEmail(email string) {
 
 	userIndexByEmail.mutex.Unlock()
 }
+
+func (userIndexByEmail *UserIndexByEmail) Count() int {
+
+	userIndexByEmail.mutex.Lock()
+
+	count := len(userIndexByEmail.emails)
+
+	userIndexByEmail.mutex.Unlock()
+
+	return count
+}
@@ -1,18 +1,25 @@
 package indexes
 
 import (
+	"github.com/json-iterator/go"
 	"hlcup_epoll/entities"
 	"sync"
-	"github.com/json-iterator/go"
 )
 
 type UserIndexById struct {
-	users map[uint][]byte
-	mutex *sync.Mutex
+	users     map[uint][]byte
+	ids       *sortedIds
+	snapshots snapshotSet
+	mutex     *sync.Mutex
 }
 
 func NewUserIndexById() *UserIndexById {
-	return &UserIndexById{users: make(map[uint][]byte), mutex: new(sync.Mutex)}
+	return &UserIndexById{
+		users:     make(map[uint][]byte),
+		ids:       newSortedIds(),
+		snapshots: make(snapshotSet),
+		mutex:     new(sync.Mutex),
+	}
 }
 
 func (userIndexById *UserIndexById) AddUser(user *entities.User) error {
@@ -25,8 +32,16 @@ func (userIndexById *UserIndexById) AddUser(user *entities.User) error {
 
 	userIndexById.mutex.Lock()
 
+	oldUserBytes, isIdExist := userIndexById.users[*user.Id]
+
+	userIndexById.snapshots.keep(*user.Id, oldUserBytes)
+
 	userIndexById.users[*user.Id] = encodedUser
 
+	if !isIdExist {
+		userIndexById.ids.add(*user.Id)
+	}
+
 	userIndexById.mutex.Unlock()
 
 	return nil
@@ -42,3 +57,42 @@ func (userIndexById *UserIndexById) GetUser(userId uint) []byte {
 
 	return userBytes
 }
+
+func (userIndexById *UserIndexById) DeleteUser(userId uint) {
+
+	userIndexById.mutex.Lock()
+
+	oldUserBytes, isIdExist := userIndexById.users[userId]
+
+	if isIdExist {
+		userIndexById.snapshots.keep(userId, oldUserBytes)
+		userIndexById.ids.remove(userId)
+	}
+
+	delete(userIndexById.users, userId)
+
+	userIndexById.mutex.Unlock()
+}
+
+// Snapshot opens a point-in-time snapshot of the users with ids in the inclusive range [fromId, toId]
+func (userIndexById *UserIndexById) Snapshot(fromId uint, toId uint) *Snapshot {
+
+	userIndexById.mutex.Lock()
+
+	snapshot := newSnapshot(userIndexById.users, userIndexById.ids, userIndexById.mutex, userIndexById.snapshots, fromId, toId)
+
+	userIndexById.mutex.Unlock()
+
+	return snapshot
+}
+
+func (userIndexById *UserIndexById) Count() int {
+
+	userIndexById.mutex.Lock()
+
+	count := len(userIndexById.users)
+
+	userIndexById.mutex.Unlock()
+
+	return count
+}
@@ -1,18 +1,25 @@
 package indexes
 
 import (
-		"hlcup_epoll/entities"
-	"sync"
 	"github.com/json-iterator/go"
+	"hlcup_epoll/entities"
+	"sync"
 )
 
 type VisitIndexById struct {
-	visits map[uint][]byte
-	mutex  *sync.Mutex
+	visits    map[uint][]byte
+	ids       *sortedIds
+	snapshots snapshotSet
+	mutex     *sync.Mutex
 }
 
 func NewVisitIndexById() *VisitIndexById {
-	return &VisitIndexById{visits: make(map[uint][]byte), mutex: new(sync.Mutex)}
+	return &VisitIndexById{
+		visits:    make(map[uint][]byte),
+		ids:       newSortedIds(),
+		snapshots: make(snapshotSet),
+		mutex:     new(sync.Mutex),
+	}
 }
 
 func (visitIndexById *VisitIndexById) AddVisit(visit *entities.Visit) error {
@@ -25,8 +32,16 @@ func (visitIndexById *VisitIndexById) AddVisit(visit *entities.Visit) error {
 
 	visitIndexById.mutex.Lock()
 
+	oldVisitBytes, isIdExist := visitIndexById.visits[*visit.Id]
+
+	visitIndexById.snapshots.keep(*visit.Id, oldVisitBytes)
+
 	visitIndexById.visits[*visit.Id] = encodedVisit
 
+	if !isIdExist {
+		visitIndexById.ids.add(*visit.Id)
+	}
+
 	visitIndexById.mutex.Unlock()
 
 	return nil
@@ -42,3 +57,57 @@ func (visitIndexById *VisitIndexById) GetVisit(visitId uint) []byte {
 
 	return visitBytes
 }
+
+func (visitIndexById *VisitIndexById) DeleteVisit(visitId uint) {
+
+	visitIndexById.mutex.Lock()
+
+	oldVisitBytes, isIdExist := visitIndexById.visits[visitId]
+
+	if isIdExist {
+		visitIndexById.snapshots.keep(visitId, oldVisitBytes)
+		visitIndexById.ids.remove(visitId)
+	}
+
+	delete(visitIndexById.visits, visitId)
+
+	visitIndexById.mutex.Unlock()
+}
+
+func (visitIndexById *VisitIndexById) GetIds() []uint {
+
+	visitIndexById.mutex.Lock()
+
+	visitsIds := make([]uint, 0, len(visitIndexById.visits))
+
+	for visitId := range visitIndexById.visits {
+		visitsIds = append(visitsIds, visitId)
+	}
+
+	visitIndexById.mutex.Unlock()
+
+	return visitsIds
+}
+
+// Snapshot opens a point-in-time snapshot of the visits with ids in the inclusive range [fromId, toId]
+func (visitIndexById *VisitIndexById) Snapshot(fromId uint, toId uint) *Snapshot {
+
+	visitIndexById.mutex.Lock()
+
+	snapshot := newSnapshot(visitIndexById.visits, visitIndexById.ids, visitIndexById.mutex, visitIndexById.snapshots, fromId, toId)
+
+	visitIndexById.mutex.Unlock()
+
+	return snapshot
+}
+
+func (visitIndexById *VisitIndexById) Count() int {
+
+	visitIndexById.mutex.Lock()
+
+	count := len(visitIndexById.visits)
+
+	visitIndexById.mutex.Unlock()
+
+	return count
+}
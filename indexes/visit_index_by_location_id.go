@@ -3,7 +3,7 @@ package indexes
 import (
 	"hlcup_epoll/entities"
 	"sync"
-	)
+)
 
 type VisitIndexByLocationId struct {
 	visits map[uint][]uint
@@ -55,3 +55,23 @@ func (visitIndexByLocationId *VisitIndexByLocationId) DeleteVisit(locationId uin
 
 	visitIndexByLocationId.mutex.Unlock()
 }
+
+func (visitIndexByLocationId *VisitIndexByLocationId) DeleteLocation(locationId uint) {
+
+	visitIndexByLocationId.mutex.Lock()
+
+	delete(visitIndexByLocationId.visits, locationId)
+
+	visitIndexByLocationId.mutex.Unlock()
+}
+
+func (visitIndexByLocationId *VisitIndexByLocationId) Count() int {
+
+	visitIndexByLocationId.mutex.Lock()
+
+	count := len(visitIndexByLocationId.visits)
+
+	visitIndexByLocationId.mutex.Unlock()
+
+	return count
+}
@@ -3,7 +3,7 @@ package indexes
 import (
 	"hlcup_epoll/entities"
 	"sync"
-		)
+)
 
 type VisitIndexByUserId struct {
 	visits map[uint][]uint
@@ -55,3 +55,23 @@ func (visitIndexByUserId *VisitIndexByUserId) DeleteVisit(userId uint, visitId u
 
 	visitIndexByUserId.mutex.Unlock()
 }
+
+func (visitIndexByUserId *VisitIndexByUserId) DeleteUser(userId uint) {
+
+	visitIndexByUserId.mutex.Lock()
+
+	delete(visitIndexByUserId.visits, userId)
+
+	visitIndexByUserId.mutex.Unlock()
+}
+
+func (visitIndexByUserId *VisitIndexByUserId) Count() int {
+
+	visitIndexByUserId.mutex.Lock()
+
+	count := len(visitIndexByUserId.visits)
+
+	visitIndexByUserId.mutex.Unlock()
+
+	return count
+}
@@ -0,0 +1,110 @@
+package indexes
+
+import (
+	"hlcup_epoll/entities"
+	"sync"
+)
+
+// VisitStats are the running totals of the visits of one user.
+// LastVisitAt can not be decremented, so it is marked stale when the latest visit goes away and recomputed on read.
+// version counts the writes, a recomputed LastVisitAt is kept only when no visit changed while it was computed.
+type VisitStats struct {
+	Count       int
+	SumOfMarks  int
+	LastVisitAt *int
+	stale       bool
+	version     int
+}
+
+type VisitStatsIndexByUserId struct {
+	stats map[uint]*VisitStats
+	mutex *sync.Mutex
+}
+
+func NewVisitStatsIndexByUserId() *VisitStatsIndexByUserId {
+	return &VisitStatsIndexByUserId{stats: make(map[uint]*VisitStats), mutex: new(sync.Mutex)}
+}
+
+func (visitStatsIndexByUserId *VisitStatsIndexByUserId) AddVisit(visit *entities.Visit) {
+
+	visitStatsIndexByUserId.mutex.Lock()
+
+	visitStats, isUserExist := visitStatsIndexByUserId.stats[*visit.User]
+
+	if !isUserExist {
+		visitStats = new(VisitStats)
+		visitStatsIndexByUserId.stats[*visit.User] = visitStats
+	}
+
+	visitStats.Count++
+	visitStats.SumOfMarks += *visit.Mark
+	visitStats.version++
+
+	if !visitStats.stale && (visitStats.LastVisitAt == nil || *visit.VisitedAt > *visitStats.LastVisitAt) {
+		visitedAt := *visit.VisitedAt
+		visitStats.LastVisitAt = &visitedAt
+	}
+
+	visitStatsIndexByUserId.mutex.Unlock()
+}
+
+func (visitStatsIndexByUserId *VisitStatsIndexByUserId) DeleteVisit(visit *entities.Visit) {
+
+	visitStatsIndexByUserId.mutex.Lock()
+
+	visitStats, isUserExist := visitStatsIndexByUserId.stats[*visit.User]
+
+	if !isUserExist {
+		visitStatsIndexByUserId.mutex.Unlock()
+		return
+	}
+
+	visitStats.Count--
+	visitStats.SumOfMarks -= *visit.Mark
+	visitStats.version++
+
+	if visitStats.LastVisitAt != nil && *visit.VisitedAt >= *visitStats.LastVisitAt {
+		visitStats.stale = true
+	}
+
+	visitStatsIndexByUserId.mutex.Unlock()
+}
+
+// GetStats returns a copy of the totals of a user and whether its LastVisitAt is stale
+func (visitStatsIndexByUserId *VisitStatsIndexByUserId) GetStats(userId uint) (VisitStats, bool) {
+
+	visitStatsIndexByUserId.mutex.Lock()
+
+	defer visitStatsIndexByUserId.mutex.Unlock()
+
+	visitStats, isUserExist := visitStatsIndexByUserId.stats[userId]
+
+	if !isUserExist {
+		return VisitStats{}, false
+	}
+
+	return *visitStats, visitStats.stale
+}
+
+// SetLastVisitAt replaces a stale LastVisitAt by the one recomputed from the visits of the user since readStats were read.
+// It is dropped when a visit of the user was written in between, the stats stay stale and are recomputed on the next read.
+func (visitStatsIndexByUserId *VisitStatsIndexByUserId) SetLastVisitAt(userId uint, readStats VisitStats, lastVisitAt *int) {
+
+	visitStatsIndexByUserId.mutex.Lock()
+
+	if visitStats, isUserExist := visitStatsIndexByUserId.stats[userId]; isUserExist && visitStats.version == readStats.version {
+		visitStats.LastVisitAt = lastVisitAt
+		visitStats.stale = false
+	}
+
+	visitStatsIndexByUserId.mutex.Unlock()
+}
+
+func (visitStatsIndexByUserId *VisitStatsIndexByUserId) DeleteUser(userId uint) {
+
+	visitStatsIndexByUserId.mutex.Lock()
+
+	delete(visitStatsIndexByUserId.stats, userId)
+
+	visitStatsIndexByUserId.mutex.Unlock()
+}
@@ -0,0 +1,51 @@
+package indexes
+
+import (
+	"hlcup_epoll/entities"
+	"testing"
+)
+
+func newTestVisit(id uint, userId uint, visitedAt int, mark int) *entities.Visit {
+	return &entities.Visit{Id: &id, User: &userId, VisitedAt: &visitedAt, Mark: &mark}
+}
+
+func TestVisitStatsStaleLastVisitAt(t *testing.T) {
+
+	visitStatsIndex := NewVisitStatsIndexByUserId()
+
+	firstVisit := newTestVisit(1, 7, 100, 3)
+	lastVisit := newTestVisit(2, 7, 200, 5)
+
+	visitStatsIndex.AddVisit(firstVisit)
+	visitStatsIndex.AddVisit(lastVisit)
+	visitStatsIndex.DeleteVisit(lastVisit)
+
+	readStats, isStale := visitStatsIndex.GetStats(7)
+
+	if !isStale || readStats.Count != 1 || readStats.SumOfMarks != 3 {
+		t.Fatalf("stats after delete = %+v, stale %v", readStats, isStale)
+	}
+
+	//a visit written while the last visit is recomputed must not be overwritten by the recomputed value
+	visitStatsIndex.AddVisit(newTestVisit(3, 7, 300, 1))
+
+	recomputed := 100
+
+	visitStatsIndex.SetLastVisitAt(7, readStats, &recomputed)
+
+	if _, isStale = visitStatsIndex.GetStats(7); !isStale {
+		t.Fatalf("a recompute older than the last write cleared the stale flag")
+	}
+
+	readStats, _ = visitStatsIndex.GetStats(7)
+
+	recomputed = 300
+
+	visitStatsIndex.SetLastVisitAt(7, readStats, &recomputed)
+
+	visitStats, isStale := visitStatsIndex.GetStats(7)
+
+	if isStale || visitStats.LastVisitAt == nil || *visitStats.LastVisitAt != 300 || visitStats.Count != 2 {
+		t.Fatalf("stats after recompute = %+v, stale %v", visitStats, isStale)
+	}
+}
@@ -2,14 +2,15 @@ package main
 
 import (
 	"hlcup_epoll/server"
-	)
+)
 
 func main() {
 
 	epollServer := server.NewServer(
 		8080,
 		"/home/artyomnorin/projects/go/src/hlcup_epoll/data/full/data.zip",
-		"/home/artyomnorin/projects/go/src/hlcup_epoll/data/full/options.txt")
+		"/home/artyomnorin/projects/go/src/hlcup_epoll/data/full/options.txt",
+		server.NewConfig())
 
 	epollServer.Run()
 }
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"github.com/json-iterator/go"
+	"golang.org/x/sys/unix"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const accessLogQueueSize = 4096
+const accessLogBufferSize = 64 * 1024
+const accessLogFlushInterval = time.Second
+
+type AccessLogFormat int
+
+const (
+	// AccessLogJSON writes every request as a JSON object on its own line
+	AccessLogJSON AccessLogFormat = iota
+	// AccessLogCommon writes the common log format followed by the duration in microseconds and the event loop
+	AccessLogCommon
+)
+
+// AccessLogEntry is one line of the access log, ResponseBytes counts the body written without the headers like the common log format
+type AccessLogEntry struct {
+	Time          time.Time `json:"-"`
+	TimeText      string    `json:"time"`
+	ClientAddress string    `json:"client"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	Proto         string    `json:"proto"`
+	Status        int       `json:"status"`
+	ResponseBytes int       `json:"response_bytes"`
+	DurationUs    int64     `json:"duration_us"`
+	LoopId        int       `json:"loop"`
+}
+
+// AccessLog writes one line per request through a buffered writer owned by one goroutine.
+// An event loop only pays for a channel send and drops its entry when the queue is full, the buffer is flushed
+// when the queue is drained or once per accessLogFlushInterval.
+type AccessLog struct {
+	format      AccessLogFormat
+	writer      *bufio.Writer
+	entries     chan *AccessLogEntry
+	errorLogger *log.Logger
+}
+
+func NewAccessLog(config *Config, errorLogger *log.Logger) *AccessLog {
+
+	file, err := os.OpenFile(config.AccessLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		errorLogger.Fatalln(err)
+	}
+
+	accessLog := &AccessLog{
+		format:      config.AccessLogFormat,
+		writer:      bufio.NewWriterSize(file, accessLogBufferSize),
+		entries:     make(chan *AccessLogEntry, accessLogQueueSize),
+		errorLogger: errorLogger,
+	}
+
+	go accessLog.write()
+
+	return accessLog
+}
+
+func (accessLog *AccessLog) Record(accessLogEntry *AccessLogEntry) {
+
+	select {
+	case accessLog.entries <- accessLogEntry:
+	default:
+	}
+}
+
+func (accessLog *AccessLog) write() {
+
+	ticker := time.NewTicker(accessLogFlushInterval)
+
+	for {
+
+		select {
+		case accessLogEntry := <-accessLog.entries:
+
+			accessLog.writeEntry(accessLogEntry)
+
+			if len(accessLog.entries) == 0 {
+				accessLog.flush()
+			}
+
+		case <-ticker.C:
+			accessLog.flush()
+		}
+	}
+}
+
+func (accessLog *AccessLog) writeEntry(accessLogEntry *AccessLogEntry) {
+
+	var lineBytes []byte
+
+	if accessLog.format == AccessLogCommon {
+		lineBytes = commonLogLine(accessLogEntry)
+
+	} else {
+
+		accessLogEntry.TimeText = accessLogEntry.Time.Format(time.RFC3339Nano)
+
+		entryBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(accessLogEntry)
+
+		if err != nil {
+			accessLog.errorLogger.Println(err)
+			return
+		}
+
+		lineBytes = entryBytes
+	}
+
+	lineBytes = append(lineBytes, '\n')
+
+	_, err := accessLog.writer.Write(lineBytes)
+
+	if err != nil {
+		accessLog.errorLogger.Println(err)
+	}
+}
+
+func (accessLog *AccessLog) flush() {
+
+	if accessLog.writer.Buffered() == 0 {
+		return
+	}
+
+	err := accessLog.writer.Flush()
+
+	if err != nil {
+		accessLog.errorLogger.Println(err)
+	}
+}
+
+// commonLogLine formats host ident authuser [date] "request" status bytes, then the duration in microseconds and the loop
+func commonLogLine(accessLogEntry *AccessLogEntry) []byte {
+
+	lineBytes := make([]byte, 0, 128)
+
+	host, _, err := net.SplitHostPort(accessLogEntry.ClientAddress)
+
+	if err != nil || host == "" {
+		host = "-"
+	}
+
+	lineBytes = append(lineBytes, host...)
+	lineBytes = append(lineBytes, " - - ["...)
+	lineBytes = append(lineBytes, accessLogEntry.Time.Format("02/Jan/2006:15:04:05 -0700")...)
+	lineBytes = append(lineBytes, "] \""...)
+	lineBytes = append(lineBytes, accessLogEntry.Method...)
+	lineBytes = append(lineBytes, ' ')
+	lineBytes = append(lineBytes, accessLogEntry.Path...)
+	lineBytes = append(lineBytes, ' ')
+	lineBytes = append(lineBytes, accessLogEntry.Proto...)
+	lineBytes = append(lineBytes, "\" "...)
+	lineBytes = strconv.AppendInt(lineBytes, int64(accessLogEntry.Status), 10)
+	lineBytes = append(lineBytes, ' ')
+	lineBytes = strconv.AppendInt(lineBytes, int64(accessLogEntry.ResponseBytes), 10)
+	lineBytes = append(lineBytes, ' ')
+	lineBytes = strconv.AppendInt(lineBytes, accessLogEntry.DurationUs, 10)
+	lineBytes = append(lineBytes, " loop="...)
+	lineBytes = strconv.AppendInt(lineBytes, int64(accessLogEntry.LoopId), 10)
+
+	return lineBytes
+}
+
+// clientAddresses keeps the peer address of every connection of an event loop from its accept until its request is read
+type clientAddresses struct {
+	addresses map[int32]string
+	mutex     *sync.Mutex
+}
+
+func newClientAddresses() *clientAddresses {
+	return &clientAddresses{addresses: make(map[int32]string), mutex: new(sync.Mutex)}
+}
+
+func (clientAddresses *clientAddresses) set(connectionFd int32, sockaddr unix.Sockaddr) {
+
+	address := formatSockaddr(sockaddr)
+
+	clientAddresses.mutex.Lock()
+
+	clientAddresses.addresses[connectionFd] = address
+
+	clientAddresses.mutex.Unlock()
+}
+
+// pop returns the address of a connection and forgets it, the descriptor may be reused by the next accept
+func (clientAddresses *clientAddresses) pop(connectionFd int32) string {
+
+	clientAddresses.mutex.Lock()
+
+	address := clientAddresses.addresses[connectionFd]
+
+	delete(clientAddresses.addresses, connectionFd)
+
+	clientAddresses.mutex.Unlock()
+
+	return address
+}
+
+func formatSockaddr(sockaddr unix.Sockaddr) string {
+
+	switch address := sockaddr.(type) {
+	case *unix.SockaddrInet4:
+		return net.JoinHostPort(net.IP(address.Addr[:]).String(), strconv.Itoa(address.Port))
+	case *unix.SockaddrInet6:
+		return net.JoinHostPort(net.IP(address.Addr[:]).String(), strconv.Itoa(address.Port))
+	}
+
+	return ""
+}
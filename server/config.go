@@ -0,0 +1,42 @@
+package server
+
+import (
+	"hlcup_epoll/services"
+	"time"
+)
+
+type Config struct {
+	CascadePolicy       services.CascadePolicy
+	ReferenceStrictness services.ReferenceStrictness
+	Timezone            *time.Location
+	AgeBuckets          []int
+	UnknownFilterParams services.UnknownParamPolicy
+	//SlowLogPath is the file of the requests slower than SlowLogThreshold, an empty path disables the slow log.
+	//Only a SlowLogSampleRate share of the requests is profiled and may be logged, 1 profiles every request.
+	SlowLogPath       string
+	SlowLogThreshold  time.Duration
+	SlowLogSampleRate float64
+	SlowLogMaxSize    int64
+	SlowLogMaxBackups int
+	//AccessLogPath is the file of one line per request, an empty path disables the access log
+	AccessLogPath   string
+	AccessLogFormat AccessLogFormat
+}
+
+func NewConfig() *Config {
+
+	return &Config{
+		CascadePolicy:       services.CascadeReject,
+		ReferenceStrictness: services.ReferencesLenient,
+		Timezone:            time.UTC,
+		AgeBuckets:          []int{18, 25, 35, 45, 55, 65},
+		UnknownFilterParams: services.UnknownParamsIgnore,
+		SlowLogPath:         "",
+		SlowLogThreshold:    100 * time.Millisecond,
+		SlowLogSampleRate:   0.01,
+		SlowLogMaxSize:      10 * 1024 * 1024,
+		SlowLogMaxBackups:   3,
+		AccessLogPath:       "",
+		AccessLogFormat:     AccessLogJSON,
+	}
+}
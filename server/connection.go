@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"hlcup_epoll/handlers"
+	"hlcup_epoll/indexes"
+	"hlcup_epoll/services"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// writeTimeoutMs is how long a pending response waits for its reader to take anything before its connection is dropped
+const writeTimeoutMs = 5000
+const stalledCheckIntervalMs = 1000
+const streamChunkSize = 64 * 1024
+
+// maxHeadersSize and maxBodySize bound what is buffered for one request, a larger request is answered 400
+const maxHeadersSize = 64 * 1024
+const maxBodySize = 32 * 1024 * 1024
+
+var headersEnd = []byte("\r\n\r\n")
+var lineEnd = []byte("\r\n")
+
+var errWriteTimeout = errors.New("write timeout")
+var errRequestTooLarge = errors.New("request too large")
+
+// isRequestComplete reports whether the headers and the whole body of a request are read,
+// a body is expected either by Content-Length or by chunked transfer encoding.
+// errRequestTooLarge is returned as soon as the headers or the body are known to exceed their limit.
+func isRequestComplete(requestBytes []byte) (bool, error) {
+
+	headersLength := bytes.Index(requestBytes, headersEnd)
+
+	if headersLength == -1 && len(requestBytes) > maxHeadersSize || headersLength > maxHeadersSize {
+		return false, errRequestTooLarge
+	}
+
+	if headersLength == -1 {
+		return false, nil
+	}
+
+	headers := bytes.ToLower(requestBytes[:headersLength])
+	body := requestBytes[headersLength+len(headersEnd):]
+
+	if len(body) > maxBodySize {
+		return false, errRequestTooLarge
+	}
+
+	if transferEncoding, ok := headerValue(headers, "transfer-encoding"); ok && bytes.Contains(transferEncoding, []byte("chunked")) {
+		return isChunkedBodyComplete(body)
+	}
+
+	contentLengthValue, ok := headerValue(headers, "content-length")
+
+	if !ok {
+		return true, nil
+	}
+
+	contentLength, err := strconv.Atoi(string(contentLengthValue))
+
+	if err != nil {
+		return true, nil
+	}
+
+	if contentLength > maxBodySize {
+		return false, errRequestTooLarge
+	}
+
+	return len(body) >= contentLength, nil
+}
+
+// headerValue returns the trimmed value of a header of the lower-cased headers. A header name is matched only at
+// the start of a line, so X-Content-Length is not taken for Content-Length.
+func headerValue(headers []byte, name string) ([]byte, bool) {
+
+	nameIndex := bytes.Index(headers, []byte("\r\n"+name+":"))
+
+	if nameIndex == -1 {
+		return nil, false
+	}
+
+	value := headers[nameIndex+len(name)+3:]
+
+	if valueEnd := bytes.Index(value, lineEnd); valueEnd != -1 {
+		value = value[:valueEnd]
+	}
+
+	return bytes.TrimSpace(value), true
+}
+
+// isChunkedBodyComplete walks the chunks of a body up to the last one and its trailers.
+// A malformed body is reported complete, the request parser refuses it.
+func isChunkedBodyComplete(body []byte) (bool, error) {
+
+	for {
+
+		sizeEnd := bytes.Index(body, lineEnd)
+
+		if sizeEnd == -1 {
+			return false, nil
+		}
+
+		sizeText := body[:sizeEnd]
+
+		if extensionIndex := bytes.IndexByte(sizeText, ';'); extensionIndex != -1 {
+			sizeText = sizeText[:extensionIndex]
+		}
+
+		size, err := strconv.ParseInt(string(bytes.TrimSpace(sizeText)), 16, 64)
+
+		if err != nil || size < 0 {
+			return true, nil
+		}
+
+		if size > maxBodySize {
+			return false, errRequestTooLarge
+		}
+
+		body = body[sizeEnd+len(lineEnd):]
+
+		if size == 0 {
+			break
+		}
+
+		if int64(len(body)) < size+int64(len(lineEnd)) {
+			return false, nil
+		}
+
+		body = body[size+int64(len(lineEnd)):]
+	}
+
+	//the last chunk is followed by the trailers, if any, and an empty line
+	return bytes.HasPrefix(body, lineEnd) || bytes.Contains(body, headersEnd), nil
+}
+
+// outgoingResponse is the part of a response which is not written yet with the request it answers.
+// A stream response keeps its snapshot and renders the next chunk of entities only when the previous one is written.
+type outgoingResponse struct {
+	chunk        []byte
+	buffer       []byte
+	snapshot     *indexes.Snapshot
+	fields       []string
+	batch        [][]byte
+	nextEntity   int
+	hasMore      bool
+	headerLength int
+	countWritten int
+	lastProgress time.Time
+	request      *http.Request
+	route        string
+	code         int
+	startTime    time.Time
+	profile      *services.QueryProfile
+	isSampled    bool
+}
+
+func newNotFoundResponse() *outgoingResponse {
+
+	return newResponse("404 OK", "text/plain", []byte("Not Found"))
+}
+
+func newBadRequestResponse(data []byte) *outgoingResponse {
+
+	if data == nil {
+		return newResponse("400 OK", "text/plain", []byte("Bad Request"))
+	}
+
+	return newResponse("400 OK", jsonContentType, data)
+}
+
+func newContentResponse(contentType string, data []byte) *outgoingResponse {
+
+	return newResponse("200 OK", contentType, data)
+}
+
+func newResponse(status string, contentType string, data []byte) *outgoingResponse {
+
+	header := fmt.Sprintf("HTTP/1.1 %s\r\nContent-Type: %s\r\nConnection: close\r\nContent-Length: %d\r\n\r\n", status, contentType, len(data))
+
+	chunk := make([]byte, 0, len(header)+len(data))
+
+	chunk = append(chunk, header...)
+	chunk = append(chunk, data...)
+
+	return &outgoingResponse{chunk: chunk, headerLength: len(header)}
+}
+
+// newStreamResponse writes the snapshot as NDJSON by chunks, the end of the body is marked by closing the connection.
+// Non-nil fields project every entity as its chunk is rendered.
+func newStreamResponse(snapshot *indexes.Snapshot, fields []string) *outgoingResponse {
+
+	header := "HTTP/1.1 200 OK\r\nContent-Type: application/x-ndjson\r\nConnection: close\r\n\r\n"
+
+	buffer := make([]byte, 0, streamChunkSize)
+
+	//the header is written from the buffer before the first chunk of entities reuses it
+	return &outgoingResponse{chunk: append(buffer, header...), buffer: buffer, snapshot: snapshot, fields: fields, hasMore: true, headerLength: len(header)}
+}
+
+// fill renders the next entities of the snapshot into the buffer, up to streamChunkSize.
+// The snapshot is read one batch at a time, so only the entities of the current batch are referenced.
+func (response *outgoingResponse) fill() {
+
+	response.chunk = response.buffer[:0]
+
+	for response.snapshot != nil && len(response.chunk) < streamChunkSize {
+
+		if response.nextEntity == len(response.batch) {
+
+			if !response.hasMore {
+				break
+			}
+
+			_, response.batch, response.hasMore = response.snapshot.Next()
+			response.nextEntity = 0
+			continue
+		}
+
+		entityBytes := response.batch[response.nextEntity]
+
+		if response.fields != nil {
+			entityBytes = handlers.ProjectEntity(entityBytes, response.fields)
+		}
+
+		response.chunk = append(response.chunk, entityBytes...)
+		response.chunk = append(response.chunk, '\n')
+
+		response.nextEntity++
+	}
+
+	response.buffer = response.chunk
+}
+
+// writeTo writes to a non-blocking socket until the response is complete or the socket is full.
+// It returns whether the response is complete and the count of bytes written by this call.
+func (response *outgoingResponse) writeTo(connectionFd int) (bool, int, error) {
+
+	countWritten := 0
+
+	for {
+
+		if len(response.chunk) == 0 {
+
+			response.fill()
+
+			if len(response.chunk) == 0 {
+				return true, countWritten, nil
+			}
+		}
+
+		countBytes, err := unix.Write(connectionFd, response.chunk)
+
+		if err == unix.EAGAIN {
+			return false, countWritten, nil
+		}
+
+		if err == unix.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return false, countWritten, err
+		}
+
+		countWritten += countBytes
+		response.chunk = response.chunk[countBytes:]
+	}
+}
+
+// bodyWritten is the count of body bytes written so far, the header is not counted
+func (response *outgoingResponse) bodyWritten() int {
+
+	if response.countWritten < response.headerLength {
+		return 0
+	}
+
+	return response.countWritten - response.headerLength
+}
+
+// close releases the snapshot of a stream which ends before it is read completely
+func (response *outgoingResponse) close() {
+
+	if response.snapshot != nil {
+		response.snapshot.Close()
+	}
+}
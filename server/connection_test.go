@@ -0,0 +1,99 @@
+package server
+
+import (
+	"hlcup_epoll/entities"
+	"hlcup_epoll/indexes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIsRequestComplete(t *testing.T) {
+
+	testCases := []struct {
+		name         string
+		request      string
+		wantComplete bool
+		wantErr      error
+	}{
+		{"empty", "", false, nil},
+		{"partial headers", "GET /users/1 HTTP/1.1\r\nHost: x\r\n", false, nil},
+		{"no body", "GET /users/1 HTTP/1.1\r\nHost: x\r\n\r\n", true, nil},
+		{"partial body", "POST /users/new HTTP/1.1\r\nContent-Length: 10\r\n\r\n{\"id\":", false, nil},
+		{"whole body", "POST /users/new HTTP/1.1\r\nContent-Length: 8\r\n\r\n{\"id\":1}", true, nil},
+		{"header case", "POST /users/new HTTP/1.1\r\ncontent-LENGTH:  8\r\n\r\n{\"id\":1}", true, nil},
+		{"chunked partial", "POST /users/bulk HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\n[]\r\n", false, nil},
+		{"chunked whole", "POST /users/bulk HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\n[]\r\n0\r\n\r\n", true, nil},
+		{"chunked data like the last chunk", "POST /users/bulk HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n0\r\n\r\n\r\n", false, nil},
+		{"chunked extension", "POST /users/bulk HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2;name=value\r\n[]\r\n0\r\n\r\n", true, nil},
+		{"chunked partial trailers", "POST /users/bulk HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\n[]\r\n0\r\nX-Checksum: 1\r\n", false, nil},
+		{"chunked trailers", "POST /users/bulk HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\n[]\r\n0\r\nX-Checksum: 1\r\n\r\n", true, nil},
+		{"huge chunk", "POST /users/bulk HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nfffffffffffffff\r\n[", false, errRequestTooLarge},
+		{"prefixed transfer encoding", "POST /users/new HTTP/1.1\r\nX-Transfer-Encoding: chunked\r\nContent-Length: 8\r\n\r\n{\"id\":1}", true, nil},
+		{"prefixed content length first", "POST /users/new HTTP/1.1\r\nX-Content-Length: 0\r\nContent-Length: 10\r\n\r\n{\"id\":", false, nil},
+		{"prefixed content length only", "POST /users/new HTTP/1.1\r\nX-Content-Length: 10\r\n\r\n", true, nil},
+		{"huge content length", "POST /users/bulk HTTP/1.1\r\nContent-Length: " + strconv.Itoa(maxBodySize+1) + "\r\n\r\n[", false, errRequestTooLarge},
+		{"huge unterminated headers", "GET / HTTP/1.1\r\nX: " + strings.Repeat("a", maxHeadersSize), false, errRequestTooLarge},
+		{"huge headers", "GET / HTTP/1.1\r\nX: " + strings.Repeat("a", maxHeadersSize) + "\r\n\r\n", false, errRequestTooLarge},
+		{"huge chunked body", "POST /users/bulk HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + strings.Repeat("a", maxBodySize+1), false, errRequestTooLarge},
+	}
+
+	for _, testCase := range testCases {
+
+		isComplete, err := isRequestComplete([]byte(testCase.request))
+
+		if isComplete != testCase.wantComplete || err != testCase.wantErr {
+			t.Errorf("%s: complete = %v, err = %v, want %v, %v", testCase.name, isComplete, err, testCase.wantComplete, testCase.wantErr)
+		}
+	}
+}
+
+func TestBodyWritten(t *testing.T) {
+
+	response := newContentResponse(jsonContentType, []byte(`{"id":1}`))
+
+	testCases := []struct {
+		countWritten int
+		want         int
+	}{
+		{0, 0},
+		{response.headerLength - 1, 0},
+		{response.headerLength, 0},
+		{response.headerLength + 8, 8},
+	}
+
+	for _, testCase := range testCases {
+
+		response.countWritten = testCase.countWritten
+
+		if bodyWritten := response.bodyWritten(); bodyWritten != testCase.want {
+			t.Errorf("%d written: body = %d, want %d", testCase.countWritten, bodyWritten, testCase.want)
+		}
+	}
+}
+
+func TestStreamResponseReusesBuffer(t *testing.T) {
+
+	userIndex := indexes.NewUserIndexById()
+
+	id, firstName := uint(1), "Anna"
+
+	userIndex.AddUser(&entities.User{Id: &id, FirstName: &firstName})
+
+	response := newStreamResponse(userIndex.Snapshot(0, 10), nil)
+
+	headerArray := &response.chunk[:1][0]
+
+	//the header is written
+	response.chunk = response.chunk[len(response.chunk):]
+
+	response.fill()
+
+	if len(response.chunk) == 0 || &response.chunk[:1][0] != headerArray {
+		t.Errorf("the first chunk of entities does not reuse the buffer of the header")
+	}
+
+	if !strings.Contains(string(response.chunk), `"Anna"`) {
+		t.Errorf("chunk = %s", response.chunk)
+	}
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"hlcup_epoll/services"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const jsonContentType = "application/json"
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// latencyBuckets are the upper bounds in seconds of the request duration histograms
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type routeStatus struct {
+	route string
+	code  int
+}
+
+type latencyHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Metrics collects the server counters and renders them in the Prometheus text format.
+// The requests are counted under the mutex, the connection and byte counters are atomic as they change on every read.
+type Metrics struct {
+	requests          map[routeStatus]uint64
+	latencies         map[string]*latencyHistogram
+	mutex             *sync.Mutex
+	activeConnections []int64
+	bytesRead         uint64
+	bytesWritten      uint64
+	acceptErrors      uint64
+	loaderDuration    time.Duration
+	storage           *services.Storage
+}
+
+func NewMetrics(storage *services.Storage, countLoops int, loaderDuration time.Duration) *Metrics {
+
+	return &Metrics{
+		requests:          make(map[routeStatus]uint64),
+		latencies:         make(map[string]*latencyHistogram),
+		mutex:             new(sync.Mutex),
+		activeConnections: make([]int64, countLoops),
+		loaderDuration:    loaderDuration,
+		storage:           storage,
+	}
+}
+
+func (metrics *Metrics) ObserveRequest(route string, code int, duration time.Duration) {
+
+	seconds := duration.Seconds()
+
+	metrics.mutex.Lock()
+
+	metrics.requests[routeStatus{route: route, code: code}]++
+
+	histogram, ok := metrics.latencies[route]
+
+	if !ok {
+		histogram = &latencyHistogram{counts: make([]uint64, len(latencyBuckets))}
+		metrics.latencies[route] = histogram
+	}
+
+	for bucketIndex, upperBound := range latencyBuckets {
+
+		if seconds <= upperBound {
+			histogram.counts[bucketIndex]++
+		}
+	}
+
+	histogram.count++
+	histogram.sum += seconds
+
+	metrics.mutex.Unlock()
+}
+
+func (metrics *Metrics) OpenConnection(loopId int) {
+
+	atomic.AddInt64(&metrics.activeConnections[loopId], 1)
+}
+
+func (metrics *Metrics) CloseConnection(loopId int) {
+
+	atomic.AddInt64(&metrics.activeConnections[loopId], -1)
+}
+
+func (metrics *Metrics) AddBytesRead(countBytes int) {
+
+	atomic.AddUint64(&metrics.bytesRead, uint64(countBytes))
+}
+
+func (metrics *Metrics) AddBytesWritten(countBytes int) {
+
+	atomic.AddUint64(&metrics.bytesWritten, uint64(countBytes))
+}
+
+func (metrics *Metrics) AddAcceptError() {
+
+	atomic.AddUint64(&metrics.acceptErrors, 1)
+}
+
+// Render returns every metric in the Prometheus text exposition format
+func (metrics *Metrics) Render() []byte {
+
+	buffer := new(bytes.Buffer)
+
+	metrics.renderRequests(buffer)
+	metrics.renderConnections(buffer)
+	metrics.renderStorage(buffer)
+	renderRuntime(buffer)
+
+	return buffer.Bytes()
+}
+
+func (metrics *Metrics) renderRequests(buffer *bytes.Buffer) {
+
+	metrics.mutex.Lock()
+
+	routeStatuses := make([]routeStatus, 0, len(metrics.requests))
+
+	for key := range metrics.requests {
+		routeStatuses = append(routeStatuses, key)
+	}
+
+	sort.Slice(routeStatuses, func(i, j int) bool {
+
+		if routeStatuses[i].route != routeStatuses[j].route {
+			return routeStatuses[i].route < routeStatuses[j].route
+		}
+
+		return routeStatuses[i].code < routeStatuses[j].code
+	})
+
+	writeHeader(buffer, "hlcup_http_requests_total", "counter", "Requests by route and status code.")
+
+	for _, key := range routeStatuses {
+		fmt.Fprintf(buffer, "hlcup_http_requests_total{route=%q,code=\"%d\"} %d\n", key.route, key.code, metrics.requests[key])
+	}
+
+	routes := make([]string, 0, len(metrics.latencies))
+
+	for route := range metrics.latencies {
+		routes = append(routes, route)
+	}
+
+	sort.Strings(routes)
+
+	writeHeader(buffer, "hlcup_http_request_duration_seconds", "histogram", "Request handling and writing duration by route.")
+
+	for _, route := range routes {
+
+		histogram := metrics.latencies[route]
+
+		for bucketIndex, upperBound := range latencyBuckets {
+			fmt.Fprintf(buffer, "hlcup_http_request_duration_seconds_bucket{route=%q,le=\"%g\"} %d\n", route, upperBound, histogram.counts[bucketIndex])
+		}
+
+		fmt.Fprintf(buffer, "hlcup_http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, histogram.count)
+		fmt.Fprintf(buffer, "hlcup_http_request_duration_seconds_sum{route=%q} %g\n", route, histogram.sum)
+		fmt.Fprintf(buffer, "hlcup_http_request_duration_seconds_count{route=%q} %d\n", route, histogram.count)
+	}
+
+	metrics.mutex.Unlock()
+}
+
+func (metrics *Metrics) renderConnections(buffer *bytes.Buffer) {
+
+	writeHeader(buffer, "hlcup_active_connections", "gauge", "Connections which are open by event loop.")
+
+	for loopId := range metrics.activeConnections {
+		fmt.Fprintf(buffer, "hlcup_active_connections{loop=\"%d\"} %d\n", loopId, atomic.LoadInt64(&metrics.activeConnections[loopId]))
+	}
+
+	writeHeader(buffer, "hlcup_read_bytes_total", "counter", "Bytes read from the clients.")
+	fmt.Fprintf(buffer, "hlcup_read_bytes_total %d\n", atomic.LoadUint64(&metrics.bytesRead))
+
+	writeHeader(buffer, "hlcup_written_bytes_total", "counter", "Bytes written to the clients.")
+	fmt.Fprintf(buffer, "hlcup_written_bytes_total %d\n", atomic.LoadUint64(&metrics.bytesWritten))
+
+	writeHeader(buffer, "hlcup_accept_errors_total", "counter", "Connections which could not be accepted.")
+	fmt.Fprintf(buffer, "hlcup_accept_errors_total %d\n", atomic.LoadUint64(&metrics.acceptErrors))
+}
+
+func (metrics *Metrics) renderStorage(buffer *bytes.Buffer) {
+
+	indexSizes := metrics.storage.GetIndexSizes()
+
+	indexNames := make([]string, 0, len(indexSizes))
+
+	for indexName := range indexSizes {
+		indexNames = append(indexNames, indexName)
+	}
+
+	sort.Strings(indexNames)
+
+	writeHeader(buffer, "hlcup_index_entries", "gauge", "Keys of every storage index.")
+
+	for _, indexName := range indexNames {
+		fmt.Fprintf(buffer, "hlcup_index_entries{index=%q} %d\n", indexName, indexSizes[indexName])
+	}
+
+	writeHeader(buffer, "hlcup_loader_duration_seconds", "gauge", "Duration of loading the data archive at startup.")
+	fmt.Fprintf(buffer, "hlcup_loader_duration_seconds %g\n", metrics.loaderDuration.Seconds())
+}
+
+func renderRuntime(buffer *bytes.Buffer) {
+
+	var memStats runtime.MemStats
+
+	runtime.ReadMemStats(&memStats)
+
+	writeHeader(buffer, "go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	fmt.Fprintf(buffer, "go_goroutines %d\n", runtime.NumGoroutine())
+
+	writeHeader(buffer, "go_memstats_alloc_bytes", "gauge", "Bytes of allocated heap objects.")
+	fmt.Fprintf(buffer, "go_memstats_alloc_bytes %d\n", memStats.Alloc)
+
+	writeHeader(buffer, "go_memstats_alloc_bytes_total", "counter", "Bytes allocated for heap objects, even if freed.")
+	fmt.Fprintf(buffer, "go_memstats_alloc_bytes_total %d\n", memStats.TotalAlloc)
+
+	writeHeader(buffer, "go_memstats_sys_bytes", "gauge", "Bytes of memory obtained from the OS.")
+	fmt.Fprintf(buffer, "go_memstats_sys_bytes %d\n", memStats.Sys)
+
+	writeHeader(buffer, "go_memstats_heap_objects", "gauge", "Number of allocated heap objects.")
+	fmt.Fprintf(buffer, "go_memstats_heap_objects %d\n", memStats.HeapObjects)
+
+	writeHeader(buffer, "go_gc_cycles_total", "counter", "Completed GC cycles.")
+	fmt.Fprintf(buffer, "go_gc_cycles_total %d\n", memStats.NumGC)
+
+	writeHeader(buffer, "go_gc_pause_seconds_total", "counter", "Cumulative GC stop-the-world pause.")
+	fmt.Fprintf(buffer, "go_gc_pause_seconds_total %g\n", time.Duration(memStats.PauseTotalNs).Seconds())
+}
+
+func writeHeader(buffer *bytes.Buffer, name string, metricType string, help string) {
+
+	fmt.Fprintf(buffer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
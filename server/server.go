@@ -1,45 +1,74 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/json-iterator/go"
 	"golang.org/x/sys/unix"
+	"hlcup_epoll/handlers"
+	"hlcup_epoll/indexes"
+	"hlcup_epoll/services"
 	"log"
 	"net"
-	"sync"
-	"bytes"
 	"net/http"
-	"bufio"
+	"net/url"
 	"os"
-	"hlcup_epoll/handlers"
 	"regexp"
-	"fmt"
-	"hlcup_epoll/services"
-	"time"
 	"runtime"
+	"sync"
+	"time"
 )
 
 var getUserRegexp *regexp.Regexp
 var getLocationRegexp *regexp.Regexp
 var getVisitRegexp *regexp.Regexp
+var userRegexp *regexp.Regexp
+var locationRegexp *regexp.Regexp
+var visitRegexp *regexp.Regexp
 var getVisitedPlacesRegexp *regexp.Regexp
+var getUserAvgMarkRegexp *regexp.Regexp
+var getUserStatsRegexp *regexp.Regexp
 var getPlaceAvgMarkRegexp *regexp.Regexp
+var getPlaceStatsRegexp *regexp.Regexp
+var getPlaceTrendRegexp *regexp.Regexp
+var getPlaceDemographicsRegexp *regexp.Regexp
+var getPlaceVisitsRegexp *regexp.Regexp
+var getPlaceVisitorsRegexp *regexp.Regexp
+var getTopPlacesRegexp *regexp.Regexp
 var createUserRegexp *regexp.Regexp
 var createLocationRegexp *regexp.Regexp
 var createVisitRegexp *regexp.Regexp
+var bulkUserRegexp *regexp.Regexp
+var bulkLocationRegexp *regexp.Regexp
+var bulkVisitRegexp *regexp.Regexp
+var exportRegexp *regexp.Regexp
+var getCountriesRegexp *regexp.Regexp
+var getCountryAvgMarkRegexp *regexp.Regexp
+var getCountryCitiesRegexp *regexp.Regexp
+var getCityAvgMarkRegexp *regexp.Regexp
+var regionNameRegexp *regexp.Regexp
+var metricsRegexp *regexp.Regexp
 var idRegexp *regexp.Regexp
 
-var responseBytes []byte
-var responseCode int
+const acceptRetryMinDelay = 5 * time.Millisecond
+const acceptRetryMaxDelay = time.Second
 
 type Server struct {
 	errorLogger        *log.Logger
-	infoLogger        *log.Logger
+	infoLogger         *log.Logger
 	port               int
 	userApiHandler     *handlers.UserApiHandler
 	locationApiHandler *handlers.LocationApiHandler
 	visitApiHandler    *handlers.VisitApiHandler
+	exportApiHandler   *handlers.ExportApiHandler
+	slowLog            *SlowLog
+	metrics            *Metrics
+	accessLog          *AccessLog
+	clientAddresses    []*clientAddresses
 }
 
-func NewServer(port int, dataPath string, optionsPath string) *Server {
+func NewServer(port int, dataPath string, optionsPath string, config *Config) *Server {
 
 	errorLogger := log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Llongfile)
 	infoLogger := log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime)
@@ -50,13 +79,20 @@ func NewServer(port int, dataPath string, optionsPath string) *Server {
 
 	storage := services.NewStorage(errorLogger, infoLogger)
 
+	storage.SetCascadePolicy(config.CascadePolicy)
+	storage.SetReferenceStrictness(config.ReferenceStrictness)
+
 	waitGroup := new(sync.WaitGroup)
 
 	storage.Init(dataPath, 4, waitGroup)
 
 	waitGroup.Wait()
 
-	infoLogger.Println(fmt.Sprintf("Storage has been filled. Duration %s", time.Since(startTime).String()))
+	storage.CheckReferences()
+
+	loaderDuration := time.Since(startTime)
+
+	infoLogger.Println(fmt.Sprintf("Storage has been filled. Duration %s", loaderDuration.String()))
 
 	printMemUsage()
 	runtime.GC()
@@ -69,7 +105,30 @@ func NewServer(port int, dataPath string, optionsPath string) *Server {
 	server.port = port
 	server.userApiHandler = handlers.NewUserApiHandler(storage, errorLogger, infoLogger, optionsPath)
 	server.locationApiHandler = handlers.NewLocationApiHandler(storage, errorLogger, infoLogger, optionsPath)
+	server.locationApiHandler.SetTimezone(config.Timezone)
+	server.locationApiHandler.SetAgeBuckets(config.AgeBuckets)
+
+	filterRegistry := services.NewFilterRegistry(config.UnknownFilterParams)
+
+	server.userApiHandler.SetFilterRegistry(filterRegistry)
+	server.locationApiHandler.SetFilterRegistry(filterRegistry)
+
+	if config.SlowLogPath != "" {
+		server.slowLog = NewSlowLog(config, errorLogger)
+	}
 	server.visitApiHandler = handlers.NewVisitApiHandler(storage, errorLogger, infoLogger)
+	server.exportApiHandler = handlers.NewExportApiHandler(storage, errorLogger, infoLogger)
+	server.metrics = NewMetrics(storage, runtime.NumCPU(), loaderDuration)
+
+	if config.AccessLogPath != "" {
+
+		server.accessLog = NewAccessLog(config, errorLogger)
+		server.clientAddresses = make([]*clientAddresses, runtime.NumCPU())
+
+		for loopId := range server.clientAddresses {
+			server.clientAddresses[loopId] = newClientAddresses()
+		}
+	}
 
 	return server
 }
@@ -80,13 +139,40 @@ func compileRegexp() {
 	getLocationRegexp = regexp.MustCompile("^/locations/\\d+.*")
 	getVisitRegexp = regexp.MustCompile("^/visits/\\d+.*")
 
+	//a write to an entity must not match its sub-resources like /users/5/visits
+	userRegexp = regexp.MustCompile("^/users/\\d+(\\?.*)?$")
+	locationRegexp = regexp.MustCompile("^/locations/\\d+(\\?.*)?$")
+	visitRegexp = regexp.MustCompile("^/visits/\\d+(\\?.*)?$")
+
 	getVisitedPlacesRegexp = regexp.MustCompile("^/users/\\d+/visits.*")
+	getUserAvgMarkRegexp = regexp.MustCompile("^/users/\\d+/avg.*")
+	getUserStatsRegexp = regexp.MustCompile("^/users/\\d+/stats.*")
 	getPlaceAvgMarkRegexp = regexp.MustCompile("^/locations/\\d+/avg.*")
+	getPlaceStatsRegexp = regexp.MustCompile("^/locations/\\d+/stats.*")
+	getPlaceTrendRegexp = regexp.MustCompile("^/locations/\\d+/trend.*")
+	getPlaceDemographicsRegexp = regexp.MustCompile("^/locations/\\d+/demographics.*")
+	getPlaceVisitsRegexp = regexp.MustCompile("^/locations/\\d+/visits(\\?.*)?$")
+	getPlaceVisitorsRegexp = regexp.MustCompile("^/locations/\\d+/visitors(\\?.*)?$")
+	getTopPlacesRegexp = regexp.MustCompile("^/locations/top(\\?.*)?$")
 
 	createUserRegexp = regexp.MustCompile("^/users/new.*")
 	createLocationRegexp = regexp.MustCompile("^/locations/new.*")
 	createVisitRegexp = regexp.MustCompile("^/visits/new.*")
 
+	bulkUserRegexp = regexp.MustCompile("^/users/bulk.*")
+	bulkLocationRegexp = regexp.MustCompile("^/locations/bulk.*")
+	bulkVisitRegexp = regexp.MustCompile("^/visits/bulk.*")
+
+	exportRegexp = regexp.MustCompile("^/export/(users|locations|visits)(\\?.*)?$")
+
+	getCountriesRegexp = regexp.MustCompile("^/countries(\\?.*)?$")
+	getCountryAvgMarkRegexp = regexp.MustCompile("^/countries/[^/?]+/avg(\\?.*)?$")
+	getCountryCitiesRegexp = regexp.MustCompile("^/countries/[^/?]+/cities(\\?.*)?$")
+	getCityAvgMarkRegexp = regexp.MustCompile("^/cities/[^/?]+/avg(\\?.*)?$")
+	regionNameRegexp = regexp.MustCompile("^/(?:countries|cities)/([^/?]+)/")
+
+	metricsRegexp = regexp.MustCompile("^/metrics(\\?.*)?$")
+
 	idRegexp = regexp.MustCompile("\\d+")
 }
 
@@ -100,9 +186,9 @@ func (server *Server) Run() {
 
 		waitGroup.Add(1)
 
-		connectionEpollFd := server.handleConnection()
+		connectionEpollFd := server.handleConnection(i)
 
-		server.handleAccept(connectionEpollFd)
+		server.handleAccept(i, connectionEpollFd)
 	}
 
 	server.infoLogger.Println(fmt.Sprintf("Server is listening on %d CPUs", cpuCount))
@@ -110,7 +196,8 @@ func (server *Server) Run() {
 	waitGroup.Wait()
 }
 
-func (server *Server) handleConnection() int {
+// handleConnection runs the event loop loopId which reads the requests and writes the responses
+func (server *Server) handleConnection(loopId int) int {
 
 	connectionEpollFd, err := unix.EpollCreate1(0)
 
@@ -119,12 +206,26 @@ func (server *Server) handleConnection() int {
 	}
 
 	events := make([]unix.EpollEvent, 1024)
+	buffer := make([]byte, 4096)
+	pendingRequests := make(map[int32][]byte)
+	pendingResponses := make(map[int32]*outgoingResponse)
 
 	go func() {
 
 		for {
 
-			countEvents, err := unix.EpollWait(connectionEpollFd, events, -1)
+			//the loop wakes up regularly only to drop the stalled readers of pending responses
+			timeoutMs := -1
+
+			if len(pendingResponses) != 0 {
+				timeoutMs = stalledCheckIntervalMs
+			}
+
+			countEvents, err := unix.EpollWait(connectionEpollFd, events, timeoutMs)
+
+			if err == unix.EINTR {
+				continue
+			}
 
 			if err != nil {
 				server.errorLogger.Fatalln(err)
@@ -132,9 +233,17 @@ func (server *Server) handleConnection() int {
 
 			for eventIndex := 0; eventIndex < countEvents; eventIndex++ {
 
-				buffer := make([]byte, 1024)
 				event := events[eventIndex]
 
+				//the socket of a partly written response became writable again
+				if response, ok := pendingResponses[event.Fd]; ok {
+					server.sendResponse(loopId, connectionEpollFd, event.Fd, response, pendingResponses)
+					continue
+				}
+
+				requestBytes := pendingRequests[event.Fd]
+				isPeerClosed := false
+
 				for {
 
 					countBytes, err := unix.Read(int(event.Fd), buffer)
@@ -145,79 +254,301 @@ func (server *Server) handleConnection() int {
 					} else if countBytes == -1 {
 						unix.Close(int(events[eventIndex].Fd))
 						server.errorLogger.Fatalln(err)
+
+					} else if countBytes == 0 {
+						isPeerClosed = true
+						break
+					}
+
+					server.metrics.AddBytesRead(countBytes)
+
+					requestBytes = append(requestBytes, buffer[:countBytes]...)
+
+					//the rest is not read once the request is too large, it is refused below
+					if len(requestBytes) > maxHeadersSize+maxBodySize {
+						break
 					}
 				}
 
-				requestReader := bytes.NewReader(buffer)
+				isComplete, err := isRequestComplete(requestBytes)
+
+				if err == errRequestTooLarge {
+					delete(pendingRequests, event.Fd)
+					server.refuseRequest(loopId, event.Fd)
+					continue
+				}
+
+				if !isComplete {
+
+					if isPeerClosed {
+						delete(pendingRequests, event.Fd)
+						server.forgetClient(loopId, event.Fd)
+						unix.Close(int(event.Fd))
+						server.metrics.CloseConnection(loopId)
+						continue
+					}
+
+					//the rest of the body is still on its way: wait for the next portion
+					pendingRequests[event.Fd] = requestBytes
+
+					epollConnectionEvent := &unix.EpollEvent{Events: unix.EPOLLET | unix.EPOLLIN | unix.EPOLLONESHOT, Fd: event.Fd}
+
+					err = unix.EpollCtl(connectionEpollFd, unix.EPOLL_CTL_MOD, int(event.Fd), epollConnectionEvent)
+
+					if err != nil {
+						delete(pendingRequests, event.Fd)
+						server.forgetClient(loopId, event.Fd)
+						unix.Close(int(event.Fd))
+						server.metrics.CloseConnection(loopId)
+						server.errorLogger.Println(err)
+					}
+
+					continue
+				}
+
+				delete(pendingRequests, event.Fd)
+
+				requestReader := bytes.NewReader(requestBytes)
 
 				bufReader := bufio.NewReader(requestReader)
 
+				requestStartTime := time.Now()
+
 				httpRequest, err := http.ReadRequest(bufReader)
 
+				//a malformed request line or URL is the client's mistake, it must not stop the server
 				if err != nil {
-					server.errorLogger.Fatalln(err)
+					server.refuseRequest(loopId, event.Fd)
+					continue
 				}
 
+				var responseSnapshot *indexes.Snapshot
+				var responseFields []string
+				var queryProfile *services.QueryProfile
+				var responseBytes []byte
+				var responseCode int
+
+				responseContentType := jsonContentType
+				route := "not_found"
+
+				isExplainRequested := isExplained(httpRequest)
+
+				//a request is known to be slow only at the end, so only the sampled ones are profiled up front
+				isSampled := server.slowLog != nil && server.slowLog.IsSampled()
+
+				if isExplainRequested || isSampled {
+					queryProfile = services.NewQueryProfile()
+					httpRequest = httpRequest.WithContext(services.WithQueryProfile(httpRequest.Context(), queryProfile))
+				}
+
+				endHandle := queryProfile.Phase("handle")
+
 				switch {
+				case metricsRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "metrics"
+					responseBytes, responseCode = server.metrics.Render(), 200
+					responseContentType = metricsContentType
+					break
+				case exportRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					entityName := exportRegexp.FindStringSubmatch(httpRequest.RequestURI)[1]
+					route = "export_" + entityName
+					responseSnapshot, responseFields, responseCode = server.exportApiHandler.Export(httpRequest, entityName)
+					break
+				case getCountriesRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "location_get_countries"
+					responseBytes, responseCode = server.locationApiHandler.GetCountries(httpRequest)
+					break
+				case getCountryAvgMarkRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "location_get_country_average_mark"
+					if name, ok := regionName(httpRequest); ok {
+						responseBytes, responseCode = server.locationApiHandler.GetCountryAverageMark(httpRequest, name)
+					} else {
+						responseCode = 404
+					}
+					break
+				case getCountryCitiesRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "location_get_country_cities"
+					if name, ok := regionName(httpRequest); ok {
+						responseBytes, responseCode = server.locationApiHandler.GetCountryCities(httpRequest, name)
+					} else {
+						responseCode = 404
+					}
+					break
+				case getCityAvgMarkRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "location_get_city_average_mark"
+					if name, ok := regionName(httpRequest); ok {
+						responseBytes, responseCode = server.locationApiHandler.GetCityAverageMark(httpRequest, name)
+					} else {
+						responseCode = 404
+					}
+					break
 				case getVisitedPlacesRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "user_get_visited_places"
 					responseBytes, responseCode = server.userApiHandler.GetVisitedPlaces(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
 					break
+				case getUserAvgMarkRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "user_get_average_mark"
+					responseBytes, responseCode = server.userApiHandler.GetAverageMark(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case getUserStatsRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "user_get_stats"
+					responseBytes, responseCode = server.userApiHandler.GetStats(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
 				case getPlaceAvgMarkRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "location_get_average_mark"
 					responseBytes, responseCode = server.locationApiHandler.GetAverageMark(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
 					break
+				case getPlaceStatsRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "location_get_stats"
+					responseBytes, responseCode = server.locationApiHandler.GetStats(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case getPlaceTrendRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "location_get_trend"
+					responseBytes, responseCode = server.locationApiHandler.GetTrend(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case getPlaceDemographicsRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "location_get_demographics"
+					responseBytes, responseCode = server.locationApiHandler.GetDemographics(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case getPlaceVisitsRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "location_get_visits"
+					responseBytes, responseCode = server.locationApiHandler.GetVisits(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case getPlaceVisitorsRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "location_get_visitors"
+					responseBytes, responseCode = server.locationApiHandler.GetVisitors(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case getTopPlacesRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "location_get_top"
+					responseBytes, responseCode = server.locationApiHandler.GetTop(httpRequest)
+					break
 				case getUserRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "user_get_by_id"
 					responseBytes, responseCode = server.userApiHandler.GetById(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
 					break
 				case getLocationRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "location_get_by_id"
 					responseBytes, responseCode = server.locationApiHandler.GetById(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
 					break
 				case getVisitRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodGet:
+					route = "visit_get_by_id"
 					responseBytes, responseCode = server.visitApiHandler.GetById(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
 					break
 				case createUserRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPost:
+					route = "user_create"
 					responseBytes, responseCode = server.userApiHandler.Create(httpRequest)
 					break
 				case createLocationRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPost:
+					route = "location_create"
 					responseBytes, responseCode = server.locationApiHandler.Create(httpRequest)
 					break
 				case createVisitRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPost:
+					route = "visit_create"
 					responseBytes, responseCode = server.visitApiHandler.Create(httpRequest)
 					break
+				case bulkUserRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPost:
+					route = "user_bulk"
+					responseBytes, responseCode = server.userApiHandler.Bulk(httpRequest)
+					break
+				case bulkLocationRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPost:
+					route = "location_bulk"
+					responseBytes, responseCode = server.locationApiHandler.Bulk(httpRequest)
+					break
+				case bulkVisitRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPost:
+					route = "visit_bulk"
+					responseBytes, responseCode = server.visitApiHandler.Bulk(httpRequest)
+					break
 				case getUserRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPost:
+					route = "user_update"
 					responseBytes, responseCode = server.userApiHandler.Update(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
 					break
 				case getLocationRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPost:
+					route = "location_update"
 					responseBytes, responseCode = server.locationApiHandler.Update(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
 					break
 				case getVisitRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPost:
+					route = "visit_update"
 					responseBytes, responseCode = server.visitApiHandler.Update(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
 					break
+				case userRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPatch:
+					route = "user_patch"
+					responseBytes, responseCode = server.userApiHandler.Patch(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case userRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPut:
+					route = "user_replace"
+					responseBytes, responseCode = server.userApiHandler.Replace(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case locationRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPatch:
+					route = "location_patch"
+					responseBytes, responseCode = server.locationApiHandler.Patch(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case locationRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPut:
+					route = "location_replace"
+					responseBytes, responseCode = server.locationApiHandler.Replace(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case visitRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPatch:
+					route = "visit_patch"
+					responseBytes, responseCode = server.visitApiHandler.Patch(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case visitRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodPut:
+					route = "visit_replace"
+					responseBytes, responseCode = server.visitApiHandler.Replace(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case userRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodDelete:
+					route = "user_delete"
+					responseBytes, responseCode = server.userApiHandler.Delete(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case locationRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodDelete:
+					route = "location_delete"
+					responseBytes, responseCode = server.locationApiHandler.Delete(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
+				case visitRegexp.MatchString(httpRequest.RequestURI) && httpRequest.Method == http.MethodDelete:
+					route = "visit_delete"
+					responseBytes, responseCode = server.visitApiHandler.Delete(httpRequest, idRegexp.FindString(httpRequest.RequestURI))
+					break
 
 				default:
 					responseCode = 404
 				}
 
-				if responseCode == 404 {
-					err = server.returnNotFound(event.Fd)
+				endHandle()
 
-				} else if responseCode == 400 {
-					err = server.returnBadRequest(event.Fd)
+				isJSONResponse := responseSnapshot == nil && responseContentType == jsonContentType
 
-				} else {
-					err = server.returnOk(event.Fd, responseBytes)
+				if responseCode == 200 && isJSONResponse && httpRequest.Method == http.MethodGet {
+					responseBytes, responseCode = handlers.ProjectFields(httpRequest, responseBytes)
 				}
 
-				if err != nil {
-					unix.Close(int(events[eventIndex].Fd))
-					server.errorLogger.Fatalln(err)
+				if responseCode == 200 && isJSONResponse && isExplainRequested && queryProfile.IsAttached() {
+					responseBytes = server.explained(responseBytes, queryProfile)
 				}
 
-				err = unix.Close(int(events[eventIndex].Fd))
+				var response *outgoingResponse
 
-				if err != nil {
-					server.errorLogger.Fatalln(err)
+				if responseCode == 200 && responseSnapshot != nil {
+					response = newStreamResponse(responseSnapshot, responseFields)
+
+				} else if responseCode == 404 {
+					response = newNotFoundResponse()
+
+				} else if responseCode == 400 {
+					response = newBadRequestResponse(responseBytes)
+
+				} else {
+					response = newContentResponse(responseContentType, responseBytes)
 				}
+
+				response.request = httpRequest
+				response.route = route
+				response.code = responseCode
+				response.startTime = requestStartTime
+				response.profile = queryProfile
+				response.isSampled = isSampled
+
+				server.sendResponse(loopId, connectionEpollFd, event.Fd, response, pendingResponses)
 			}
+
+			server.dropStalledResponses(loopId, pendingResponses)
 		}
 
 	}()
@@ -225,40 +556,104 @@ func (server *Server) handleConnection() int {
 	return connectionEpollFd
 }
 
-func (server *Server) returnNotFound(connectionFd int32) error {
+// sendResponse writes as much of the response as the socket takes. When the socket is full the rest is written
+// on the next EPOLLOUT event of the connection, so a slow reader never blocks the other connections of the loop.
+func (server *Server) sendResponse(loopId int, connectionEpollFd int, connectionFd int32, response *outgoingResponse, pendingResponses map[int32]*outgoingResponse) {
+
+	isDone, countBytes, err := response.writeTo(int(connectionFd))
 
-	response := make([]byte, 0)
+	response.countWritten += countBytes
 
-	response = append(response, fmt.Sprintf("HTTP/1.1 404 OK\r\nContent-Type: text/plain\r\nConnection: close\r\nContent-Length: %d\r\n\r\nNot Found", len("Not Found"))...)
+	server.metrics.AddBytesWritten(countBytes)
 
-	_, err := unix.Write(int(connectionFd), response)
+	//the client is gone, it must not stop the server
+	if err != nil {
+		server.errorLogger.Println(err)
+	}
 
-	return err
+	if isDone || err != nil {
+		server.finishResponse(loopId, connectionFd, response, pendingResponses)
+		return
+	}
+
+	if countBytes != 0 || response.lastProgress.IsZero() {
+		response.lastProgress = time.Now()
+	}
+
+	pendingResponses[connectionFd] = response
+
+	epollConnectionEvent := &unix.EpollEvent{Events: unix.EPOLLET | unix.EPOLLOUT | unix.EPOLLONESHOT, Fd: connectionFd}
+
+	err = unix.EpollCtl(connectionEpollFd, unix.EPOLL_CTL_MOD, int(connectionFd), epollConnectionEvent)
+
+	if err != nil {
+		server.errorLogger.Println(err)
+		server.finishResponse(loopId, connectionFd, response, pendingResponses)
+	}
 }
 
-func (server *Server) returnBadRequest(connectionFd int32) error {
+// refuseRequest answers 400 to a request which is not handled and closes its connection. The refusal is written
+// only if it fits into the socket buffer, the connection is not kept for it.
+func (server *Server) refuseRequest(loopId int, connectionFd int32) {
+
+	server.forgetClient(loopId, connectionFd)
 
-	response := make([]byte, 0)
+	_, countBytes, err := newBadRequestResponse(nil).writeTo(int(connectionFd))
 
-	response = append(response, fmt.Sprintf("HTTP/1.1 400 OK\r\nContent-Type: text/plain\r\nConnection: close\r\nContent-Length: %d\r\n\r\nBad Request", len("Bad Request"))...)
+	server.metrics.AddBytesWritten(countBytes)
 
-	_, err := unix.Write(int(connectionFd), response)
+	if err != nil {
+		server.errorLogger.Println(err)
+	}
 
-	return err
+	unix.Close(int(connectionFd))
+	server.metrics.CloseConnection(loopId)
 }
 
-func (server *Server) returnOk(connectionFd int32, data []byte) error {
+// finishResponse records the request and closes its connection, whether the response was written completely or not
+func (server *Server) finishResponse(loopId int, connectionFd int32, response *outgoingResponse, pendingResponses map[int32]*outgoingResponse) {
+
+	delete(pendingResponses, connectionFd)
 
-	response := make([]byte, 0)
+	response.close()
 
-	response = append(response, fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nConnection: close\r\nContent-Length: %d\r\n\r\n%s", len(data), string(data))...)
+	duration := time.Since(response.startTime)
 
-	_, err := unix.Write(int(connectionFd), response)
+	server.metrics.ObserveRequest(response.route, response.code, duration)
 
-	return err
+	if server.accessLog != nil {
+		server.recordAccess(response.request, response.startTime, duration, response.code, response.bodyWritten(), loopId, connectionFd)
+	}
+
+	if response.isSampled {
+		server.recordSlowRequest(response.request, response.startTime, duration, response.code, response.bodyWritten(), response.profile)
+	}
+
+	err := unix.Close(int(connectionFd))
+
+	server.metrics.CloseConnection(loopId)
+
+	if err != nil {
+		server.errorLogger.Fatalln(err)
+	}
 }
 
-func (server *Server) handleAccept(connectionEpollFd int) {
+// dropStalledResponses closes the connections whose reader took nothing for writeTimeoutMs
+func (server *Server) dropStalledResponses(loopId int, pendingResponses map[int32]*outgoingResponse) {
+
+	for connectionFd, response := range pendingResponses {
+
+		if time.Since(response.lastProgress) < writeTimeoutMs*time.Millisecond {
+			continue
+		}
+
+		server.errorLogger.Println(errWriteTimeout)
+		server.finishResponse(loopId, connectionFd, response, pendingResponses)
+	}
+}
+
+// handleAccept passes the accepted connections to the event loop loopId
+func (server *Server) handleAccept(loopId int, connectionEpollFd int) {
 
 	socketAddr := &unix.SockaddrInet4{Port: server.port}
 	copy(socketAddr.Addr[:], net.ParseIP(`0.0.0.0`).To4())
@@ -350,44 +745,63 @@ func (server *Server) handleAccept(connectionEpollFd int) {
 
 			for eventIndex := 0; eventIndex < countEvents; eventIndex++ {
 
+				retryDelay := time.Duration(0)
+
 				for {
 
-					connectionFd, _, err := unix.Accept(socketFd)
+					connectionFd, sockaddr, err := unix.Accept(socketFd)
 
 					if connectionFd == -1 && err == unix.EAGAIN {
 						break
 
-					} else if connectionFd == -1 {
-						unix.Close(socketFd)
-						unix.Close(socketEpollFd)
-						unix.Close(connectionFd)
-						server.errorLogger.Fatalln(err)
-					}
+					} else if connectionFd == -1 && (err == unix.EINTR || err == unix.ECONNABORTED) {
+						server.metrics.AddAcceptError()
+						continue
 
-					if err != nil {
-						unix.Close(socketFd)
-						unix.Close(socketEpollFd)
-						server.errorLogger.Fatalln(err)
+					} else if connectionFd == -1 || err != nil {
+
+						//out of descriptors or memory: the listener is edge triggered and the backlog would not raise
+						//a new event, so accepting is retried after a growing delay until the backlog is drained
+						server.metrics.AddAcceptError()
+
+						if retryDelay == 0 {
+							server.errorLogger.Println(err)
+							retryDelay = acceptRetryMinDelay
+						} else if retryDelay < acceptRetryMaxDelay {
+							retryDelay *= 2
+						}
+
+						time.Sleep(retryDelay)
+						continue
 					}
 
+					retryDelay = 0
+
 					err = unix.SetNonblock(connectionFd, true)
 
 					if err != nil {
-						unix.Close(socketFd)
-						unix.Close(socketEpollFd)
 						unix.Close(connectionFd)
-						server.errorLogger.Fatalln(err)
+						server.metrics.AddAcceptError()
+						server.errorLogger.Println(err)
+						continue
 					}
 
 					epollConnectionEvent := &unix.EpollEvent{Events: unix.EPOLLET | unix.EPOLLIN | unix.EPOLLONESHOT, Fd: int32(connectionFd)}
 
+					server.metrics.OpenConnection(loopId)
+
+					if server.accessLog != nil {
+						server.clientAddresses[loopId].set(int32(connectionFd), sockaddr)
+					}
+
 					err = unix.EpollCtl(connectionEpollFd, unix.EPOLL_CTL_ADD, connectionFd, epollConnectionEvent)
 
 					if err != nil {
-						unix.Close(socketFd)
-						unix.Close(socketEpollFd)
+						server.forgetClient(loopId, int32(connectionFd))
 						unix.Close(connectionFd)
-						server.errorLogger.Fatalln(err)
+						server.metrics.CloseConnection(loopId)
+						server.metrics.AddAcceptError()
+						server.errorLogger.Println(err)
 					}
 				}
 			}
@@ -396,6 +810,105 @@ func (server *Server) handleAccept(connectionEpollFd int) {
 	}()
 }
 
+func (server *Server) recordSlowRequest(httpRequest *http.Request, requestStartTime time.Time, duration time.Duration, code int, countBodyBytes int, queryProfile *services.QueryProfile) {
+
+	if !server.slowLog.IsSlow(duration) {
+		return
+	}
+
+	slowLogEntry := &SlowLogEntry{
+		Time:          requestStartTime.Format(time.RFC3339Nano),
+		Request:       httpRequest.Method + " " + httpRequest.RequestURI + " " + httpRequest.Proto,
+		Status:        code,
+		DurationUs:    duration.Nanoseconds() / int64(time.Microsecond),
+		ResponseBytes: countBodyBytes,
+	}
+
+	if queryProfile.IsAttached() {
+		slowLogEntry.Profile = queryProfile
+	}
+
+	server.slowLog.Record(slowLogEntry)
+}
+
+func (server *Server) recordAccess(httpRequest *http.Request, requestStartTime time.Time, duration time.Duration, code int, countBodyBytes int, loopId int, connectionFd int32) {
+
+	server.accessLog.Record(&AccessLogEntry{
+		Time:          requestStartTime,
+		ClientAddress: server.clientAddresses[loopId].pop(connectionFd),
+		Method:        httpRequest.Method,
+		Path:          httpRequest.RequestURI,
+		Proto:         httpRequest.Proto,
+		Status:        code,
+		ResponseBytes: countBodyBytes,
+		DurationUs:    duration.Nanoseconds() / int64(time.Microsecond),
+		LoopId:        loopId,
+	})
+}
+
+// forgetClient drops the address of a connection closed before its request was logged
+func (server *Server) forgetClient(loopId int, connectionFd int32) {
+
+	if server.accessLog != nil {
+		server.clientAddresses[loopId].pop(connectionFd)
+	}
+}
+
+// isExplained reports whether a GET request asks for its query profile by explain=1 or the X-Explain header
+func isExplained(httpRequest *http.Request) bool {
+
+	if httpRequest.Method != http.MethodGet {
+		return false
+	}
+
+	explain := httpRequest.URL.Query().Get("explain")
+
+	if explain == "" {
+		explain = httpRequest.Header.Get("X-Explain")
+	}
+
+	return explain == "1" || explain == "true"
+}
+
+// explained puts the response next to the profile of its queries
+func (server *Server) explained(responseBytes []byte, queryProfile *services.QueryProfile) []byte {
+
+	queryProfileBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(queryProfile)
+
+	if err != nil {
+		server.errorLogger.Fatalln(err)
+	}
+
+	explainedBytes := make([]byte, 0, len(responseBytes)+len(queryProfileBytes)+32)
+
+	explainedBytes = append(explainedBytes, `{"result":`...)
+	explainedBytes = append(explainedBytes, responseBytes...)
+	explainedBytes = append(explainedBytes, `,"explain":`...)
+	explainedBytes = append(explainedBytes, queryProfileBytes...)
+	explainedBytes = append(explainedBytes, '}')
+
+	return explainedBytes
+}
+
+// regionName returns the unescaped country or city name from the path. The name is taken from the raw path
+// the routes are matched on, an escaped slash belongs to the name.
+func regionName(httpRequest *http.Request) (string, bool) {
+
+	match := regionNameRegexp.FindStringSubmatch(httpRequest.RequestURI)
+
+	if match == nil {
+		return "", false
+	}
+
+	name, err := url.PathUnescape(match[1])
+
+	if err != nil {
+		return "", false
+	}
+
+	return name, true
+}
+
 func printMemUsage() {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
@@ -408,4 +921,4 @@ func printMemUsage() {
 
 func bToMb(b uint64) uint64 {
 	return b / 1024 / 1024
-}
\ No newline at end of file
+}
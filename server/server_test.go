@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegionName(t *testing.T) {
+
+	compileRegexp()
+
+	testCases := []struct {
+		path     string
+		wantName string
+		wantOk   bool
+	}{
+		{"/countries/Spain/avg", "Spain", true},
+		{"/countries/United%20States/cities?limit=1", "United States", true},
+		{"/cities/a%2Fb/avg", "a/b", true},
+		{"/countries/%2F/avg", "/", true},
+		{"/countries/%ZZ/avg", "", false},
+		{"/countries//avg", "", false},
+	}
+
+	for _, testCase := range testCases {
+
+		request := httptest.NewRequest("GET", "/", nil)
+		request.RequestURI = testCase.path
+
+		name, ok := regionName(request)
+
+		if name != testCase.wantName || ok != testCase.wantOk {
+			t.Errorf("%s: name = %q, %v, want %q, %v", testCase.path, name, ok, testCase.wantName, testCase.wantOk)
+		}
+	}
+}
+
+func TestEntityRoutes(t *testing.T) {
+
+	compileRegexp()
+
+	testCases := []struct {
+		path         string
+		wantUser     bool
+		wantLocation bool
+		wantVisit    bool
+	}{
+		{"/users/5", true, false, false},
+		{"/users/5?query_id=1", true, false, false},
+		{"/locations/7", false, true, false},
+		{"/visits/9", false, false, true},
+		{"/users/5/visits", false, false, false},
+		{"/users/5/avg", false, false, false},
+		{"/users/5abc", false, false, false},
+		{"/users/new", false, false, false},
+		{"/locations/7/avg", false, false, false},
+		{"/locations/7/visitors?limit=1", false, false, false},
+		{"/visits/9/", false, false, false},
+	}
+
+	for _, testCase := range testCases {
+
+		if isMatch := userRegexp.MatchString(testCase.path); isMatch != testCase.wantUser {
+			t.Errorf("%s: user route = %v, want %v", testCase.path, isMatch, testCase.wantUser)
+		}
+
+		if isMatch := locationRegexp.MatchString(testCase.path); isMatch != testCase.wantLocation {
+			t.Errorf("%s: location route = %v, want %v", testCase.path, isMatch, testCase.wantLocation)
+		}
+
+		if isMatch := visitRegexp.MatchString(testCase.path); isMatch != testCase.wantVisit {
+			t.Errorf("%s: visit route = %v, want %v", testCase.path, isMatch, testCase.wantVisit)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"github.com/json-iterator/go"
+	"hlcup_epoll/services"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+)
+
+const slowLogQueueSize = 1024
+
+// SlowLogEntry is one line of the slow log
+type SlowLogEntry struct {
+	Time          string                 `json:"time"`
+	Request       string                 `json:"request"`
+	Status        int                    `json:"status"`
+	DurationUs    int64                  `json:"duration_us"`
+	ResponseBytes int                    `json:"response_bytes"`
+	Profile       *services.QueryProfile `json:"profile,omitempty"`
+}
+
+// SlowLog writes the requests slower than threshold as JSON lines, a sampleRate share of them is kept.
+// Entries are written by one goroutine, a request only pays for a channel send and drops its entry when the queue is full.
+type SlowLog struct {
+	threshold   time.Duration
+	sampleRate  float64
+	path        string
+	maxSize     int64
+	maxBackups  int
+	file        *os.File
+	size        int64
+	entries     chan *SlowLogEntry
+	errorLogger *log.Logger
+}
+
+func NewSlowLog(config *Config, errorLogger *log.Logger) *SlowLog {
+
+	slowLog := &SlowLog{
+		threshold:   config.SlowLogThreshold,
+		sampleRate:  config.SlowLogSampleRate,
+		path:        config.SlowLogPath,
+		maxSize:     config.SlowLogMaxSize,
+		maxBackups:  config.SlowLogMaxBackups,
+		entries:     make(chan *SlowLogEntry, slowLogQueueSize),
+		errorLogger: errorLogger,
+	}
+
+	slowLog.open()
+
+	go slowLog.write()
+
+	return slowLog
+}
+
+// IsSampled decides when a request starts whether it is a candidate for the slow log, only those are profiled
+func (slowLog *SlowLog) IsSampled() bool {
+
+	return slowLog.sampleRate >= 1 || rand.Float64() < slowLog.sampleRate
+}
+
+// IsSlow reports whether a sampled request which took duration is logged
+func (slowLog *SlowLog) IsSlow(duration time.Duration) bool {
+
+	return duration >= slowLog.threshold
+}
+
+func (slowLog *SlowLog) Record(slowLogEntry *SlowLogEntry) {
+
+	select {
+	case slowLog.entries <- slowLogEntry:
+	default:
+	}
+}
+
+func (slowLog *SlowLog) write() {
+
+	for slowLogEntry := range slowLog.entries {
+
+		slowLogEntryBytes, err := jsoniter.ConfigCompatibleWithStandardLibrary.Marshal(slowLogEntry)
+
+		if err != nil {
+			slowLog.errorLogger.Println(err)
+			continue
+		}
+
+		slowLogEntryBytes = append(slowLogEntryBytes, '\n')
+
+		if slowLog.maxSize != 0 && slowLog.size+int64(len(slowLogEntryBytes)) > slowLog.maxSize {
+			slowLog.rotate()
+		}
+
+		if slowLog.file == nil {
+			continue
+		}
+
+		countBytes, err := slowLog.file.Write(slowLogEntryBytes)
+
+		slowLog.size += int64(countBytes)
+
+		if err != nil {
+			slowLog.errorLogger.Println(err)
+		}
+	}
+}
+
+func (slowLog *SlowLog) open() {
+
+	file, err := os.OpenFile(slowLog.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		slowLog.errorLogger.Println(err)
+		return
+	}
+
+	fileInfo, err := file.Stat()
+
+	if err == nil {
+		slowLog.size = fileInfo.Size()
+	}
+
+	slowLog.file = file
+}
+
+// rotate shifts path.1 ... path.maxBackups-1 by one, the current file becomes path.1 and the oldest one is removed
+func (slowLog *SlowLog) rotate() {
+
+	if slowLog.file != nil {
+		slowLog.file.Close()
+	}
+
+	if slowLog.maxBackups == 0 {
+		os.Remove(slowLog.path)
+	}
+
+	for backup := slowLog.maxBackups - 1; backup > 0; backup-- {
+		os.Rename(fmt.Sprintf("%s.%d", slowLog.path, backup), fmt.Sprintf("%s.%d", slowLog.path, backup+1))
+	}
+
+	if slowLog.maxBackups != 0 {
+		os.Rename(slowLog.path, slowLog.path+".1")
+	}
+
+	slowLog.size = 0
+	slowLog.file = nil
+
+	slowLog.open()
+}
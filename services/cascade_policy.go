@@ -0,0 +1,18 @@
+package services
+
+import "errors"
+
+// CascadePolicy defines what happens to the visits of a user or a location when it is deleted
+type CascadePolicy int
+
+const (
+	// CascadeReject refuses to delete an entity that still has visits
+	CascadeReject CascadePolicy = iota
+	// CascadeDelete deletes the visits together with the entity
+	CascadeDelete
+	// CascadeOrphan keeps the visits, leaving them with a dangling reference
+	CascadeOrphan
+)
+
+var ErrEntityNotFound = errors.New("entity not found")
+var ErrEntityHasVisits = errors.New("entity still has visits")
@@ -0,0 +1,615 @@
+package services
+
+import (
+	"fmt"
+	"hlcup_epoll/entities"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// FilterSyntaxError points at the 1-based position of the filter expression where compiling failed
+type FilterSyntaxError struct {
+	Position int
+	Reason   string
+}
+
+func (filterSyntaxError *FilterSyntaxError) Error() string {
+	return fmt.Sprintf("position %d: %s", filterSyntaxError.Position, filterSyntaxError.Reason)
+}
+
+// FilterSubject is what a filter expression is evaluated on: a visit with its user and its location
+type FilterSubject struct {
+	Visit              *entities.Visit
+	User               *entities.User
+	Location           *entities.Location
+	timeDataGeneration time.Time
+}
+
+// FilterExpression is a compiled filter like
+//
+//	mark>=4 and country in ("Russia","Spain") and age between 20 and 30
+//
+// comparisons (= != < <= > >=), in, between and their negations are combined with and, or, not and parentheses
+type FilterExpression struct {
+	predicate filterPredicate
+}
+
+type filterPredicate func(subject *FilterSubject) bool
+
+type filterAttributeKind int
+
+const (
+	intAttribute filterAttributeKind = iota
+	stringAttribute
+)
+
+type filterAttribute struct {
+	kind        filterAttributeKind
+	intValue    func(subject *FilterSubject) int
+	stringValue func(subject *FilterSubject) string
+}
+
+var filterAttributes = map[string]*filterAttribute{
+	"id":         {kind: intAttribute, intValue: func(subject *FilterSubject) int { return int(*subject.Visit.Id) }},
+	"mark":       {kind: intAttribute, intValue: func(subject *FilterSubject) int { return *subject.Visit.Mark }},
+	"visited_at": {kind: intAttribute, intValue: func(subject *FilterSubject) int { return *subject.Visit.VisitedAt }},
+	"user":       {kind: intAttribute, intValue: func(subject *FilterSubject) int { return int(*subject.Visit.User) }},
+	"location":   {kind: intAttribute, intValue: func(subject *FilterSubject) int { return int(*subject.Visit.Location) }},
+	"distance":   {kind: intAttribute, intValue: func(subject *FilterSubject) int { return int(*subject.Location.Distance) }},
+	"birth_date": {kind: intAttribute, intValue: func(subject *FilterSubject) int { return *subject.User.BirthDate }},
+	"age": {kind: intAttribute, intValue: func(subject *FilterSubject) int {
+		return AgeAt(*subject.User.BirthDate, subject.timeDataGeneration)
+	}},
+	"country":    {kind: stringAttribute, stringValue: func(subject *FilterSubject) string { return *subject.Location.Country }},
+	"city":       {kind: stringAttribute, stringValue: func(subject *FilterSubject) string { return *subject.Location.City }},
+	"place":      {kind: stringAttribute, stringValue: func(subject *FilterSubject) string { return *subject.Location.Place }},
+	"gender":     {kind: stringAttribute, stringValue: func(subject *FilterSubject) string { return *subject.User.Gender }},
+	"email":      {kind: stringAttribute, stringValue: func(subject *FilterSubject) string { return *subject.User.Email }},
+	"first_name": {kind: stringAttribute, stringValue: func(subject *FilterSubject) string { return *subject.User.FirstName }},
+	"last_name":  {kind: stringAttribute, stringValue: func(subject *FilterSubject) string { return *subject.User.LastName }},
+}
+
+// AgeAt returns the number of full years from birthDate to moment
+func AgeAt(birthDate int, moment time.Time) int {
+
+	birthTime := time.Unix(int64(birthDate), 0).UTC()
+	moment = moment.UTC()
+
+	age := moment.Year() - birthTime.Year()
+
+	if moment.Month() < birthTime.Month() || (moment.Month() == birthTime.Month() && moment.Day() < birthTime.Day()) {
+		age--
+	}
+
+	return age
+}
+
+// CompileFilterExpression parses an expression into a predicate, the error is a *FilterSyntaxError
+func CompileFilterExpression(expression string) (*FilterExpression, error) {
+
+	tokens, err := tokenizeFilter(expression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &filterParser{tokens: tokens}
+
+	predicate, err := parser.parseOr()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.current().kind != endToken {
+		return nil, parser.fail("unexpected " + parser.current().describe())
+	}
+
+	return &FilterExpression{predicate: predicate}, nil
+}
+
+func (filterExpression *FilterExpression) Match(subject *FilterSubject) bool {
+	return filterExpression.predicate(subject)
+}
+
+type filterTokenKind int
+
+const (
+	endToken filterTokenKind = iota
+	identToken
+	numberToken
+	stringToken
+	operatorToken
+	openToken
+	closeToken
+	commaToken
+)
+
+type filterToken struct {
+	kind     filterTokenKind
+	text     string
+	position int
+}
+
+func (token *filterToken) describe() string {
+
+	switch token.kind {
+	case endToken:
+		return "end of expression"
+	case stringToken:
+		return strconv.Quote(token.text)
+	default:
+		return "'" + token.text + "'"
+	}
+}
+
+// is reports whether the token is the keyword, keywords are case-insensitive
+func (token *filterToken) is(keyword string) bool {
+	return token.kind == identToken && strings.EqualFold(token.text, keyword)
+}
+
+func tokenizeFilter(expression string) ([]*filterToken, error) {
+
+	tokens := make([]*filterToken, 0)
+
+	runes := []rune(expression)
+
+	for index := 0; index < len(runes); {
+
+		character := runes[index]
+		start := index
+
+		switch {
+		case unicode.IsSpace(character):
+			index++
+			continue
+		case character == '(':
+			tokens = append(tokens, &filterToken{kind: openToken, text: "(", position: start + 1})
+			index++
+		case character == ')':
+			tokens = append(tokens, &filterToken{kind: closeToken, text: ")", position: start + 1})
+			index++
+		case character == ',':
+			tokens = append(tokens, &filterToken{kind: commaToken, text: ",", position: start + 1})
+			index++
+		case character == '=' || character == '<' || character == '>' || character == '!':
+			index++
+
+			if index < len(runes) && runes[index] == '=' {
+				index++
+			}
+
+			operator := string(runes[start:index])
+
+			if operator == "!" || operator == "==" {
+				return nil, &FilterSyntaxError{Position: start + 1, Reason: "unknown operator '" + operator + "'"}
+			}
+
+			tokens = append(tokens, &filterToken{kind: operatorToken, text: operator, position: start + 1})
+		case character == '"':
+			index++
+
+			value := make([]rune, 0)
+
+			for index < len(runes) && runes[index] != '"' {
+
+				if runes[index] == '\\' && index+1 < len(runes) {
+					index++
+				}
+
+				value = append(value, runes[index])
+				index++
+			}
+
+			if index == len(runes) {
+				return nil, &FilterSyntaxError{Position: start + 1, Reason: "unterminated string"}
+			}
+
+			index++
+
+			tokens = append(tokens, &filterToken{kind: stringToken, text: string(value), position: start + 1})
+		case character == '-' || unicode.IsDigit(character):
+			index++
+
+			for index < len(runes) && unicode.IsDigit(runes[index]) {
+				index++
+			}
+
+			if runes[index-1] == '-' {
+				return nil, &FilterSyntaxError{Position: start + 1, Reason: "expected a digit after '-'"}
+			}
+
+			tokens = append(tokens, &filterToken{kind: numberToken, text: string(runes[start:index]), position: start + 1})
+		case character == '_' || unicode.IsLetter(character):
+			index++
+
+			for index < len(runes) && (runes[index] == '_' || unicode.IsLetter(runes[index]) || unicode.IsDigit(runes[index])) {
+				index++
+			}
+
+			tokens = append(tokens, &filterToken{kind: identToken, text: string(runes[start:index]), position: start + 1})
+		default:
+			return nil, &FilterSyntaxError{Position: start + 1, Reason: fmt.Sprintf("unexpected character '%c'", character)}
+		}
+	}
+
+	return append(tokens, &filterToken{kind: endToken, position: len(runes) + 1}), nil
+}
+
+type filterParser struct {
+	tokens []*filterToken
+	index  int
+}
+
+func (parser *filterParser) current() *filterToken {
+	return parser.tokens[parser.index]
+}
+
+func (parser *filterParser) next() *filterToken {
+
+	token := parser.tokens[parser.index]
+
+	if token.kind != endToken {
+		parser.index++
+	}
+
+	return token
+}
+
+func (parser *filterParser) fail(reason string) error {
+	return &FilterSyntaxError{Position: parser.current().position, Reason: reason}
+}
+
+func (parser *filterParser) parseOr() (filterPredicate, error) {
+
+	left, err := parser.parseAnd()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for parser.current().is("or") {
+
+		parser.next()
+
+		right, err := parser.parseAnd()
+
+		if err != nil {
+			return nil, err
+		}
+
+		left = orPredicate(left, right)
+	}
+
+	return left, nil
+}
+
+func (parser *filterParser) parseAnd() (filterPredicate, error) {
+
+	left, err := parser.parseNot()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for parser.current().is("and") {
+
+		parser.next()
+
+		right, err := parser.parseNot()
+
+		if err != nil {
+			return nil, err
+		}
+
+		left = andPredicate(left, right)
+	}
+
+	return left, nil
+}
+
+func (parser *filterParser) parseNot() (filterPredicate, error) {
+
+	if parser.current().is("not") {
+
+		parser.next()
+
+		operand, err := parser.parseNot()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return notPredicate(operand), nil
+	}
+
+	if parser.current().kind == openToken {
+
+		parser.next()
+
+		predicate, err := parser.parseOr()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if parser.current().kind != closeToken {
+			return nil, parser.fail("expected ')' but found " + parser.current().describe())
+		}
+
+		parser.next()
+
+		return predicate, nil
+	}
+
+	return parser.parseComparison()
+}
+
+func (parser *filterParser) parseComparison() (filterPredicate, error) {
+
+	if parser.current().kind != identToken {
+		return nil, parser.fail("expected an attribute but found " + parser.current().describe())
+	}
+
+	attributeToken := parser.next()
+
+	attribute, ok := filterAttributes[attributeToken.text]
+
+	if !ok {
+		return nil, &FilterSyntaxError{Position: attributeToken.position, Reason: "unknown attribute '" + attributeToken.text + "'"}
+	}
+
+	negated := false
+
+	if parser.current().is("not") {
+		parser.next()
+		negated = true
+	}
+
+	var predicate filterPredicate
+	var err error
+
+	switch {
+	case parser.current().is("in"):
+		parser.next()
+		predicate, err = parser.parseIn(attribute)
+	case parser.current().is("between"):
+		parser.next()
+		predicate, err = parser.parseBetween(attribute)
+	case parser.current().kind == operatorToken && !negated:
+		operator := parser.next().text
+		predicate, err = parser.parseCompare(attribute, operator)
+	default:
+		return nil, parser.fail("expected an operator, in or between but found " + parser.current().describe())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if negated {
+		return notPredicate(predicate), nil
+	}
+
+	return predicate, nil
+}
+
+func (parser *filterParser) parseCompare(attribute *filterAttribute, operator string) (filterPredicate, error) {
+
+	if attribute.kind == intAttribute {
+
+		value, err := parser.parseInt()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return func(subject *FilterSubject) bool {
+			return compareInts(attribute.intValue(subject), value, operator)
+		}, nil
+	}
+
+	value, err := parser.parseString()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return func(subject *FilterSubject) bool {
+		return compareStrings(attribute.stringValue(subject), value, operator)
+	}, nil
+}
+
+func (parser *filterParser) parseIn(attribute *filterAttribute) (filterPredicate, error) {
+
+	if parser.current().kind != openToken {
+		return nil, parser.fail("expected '(' but found " + parser.current().describe())
+	}
+
+	parser.next()
+
+	intValues := make([]int, 0)
+	stringValues := make([]string, 0)
+
+	for {
+
+		if attribute.kind == intAttribute {
+
+			value, err := parser.parseInt()
+
+			if err != nil {
+				return nil, err
+			}
+
+			intValues = append(intValues, value)
+		} else {
+
+			value, err := parser.parseString()
+
+			if err != nil {
+				return nil, err
+			}
+
+			stringValues = append(stringValues, value)
+		}
+
+		if parser.current().kind == closeToken {
+			parser.next()
+			break
+		}
+
+		if parser.current().kind != commaToken {
+			return nil, parser.fail("expected ',' or ')' but found " + parser.current().describe())
+		}
+
+		parser.next()
+	}
+
+	if attribute.kind == intAttribute {
+
+		return func(subject *FilterSubject) bool {
+
+			actual := attribute.intValue(subject)
+
+			for _, value := range intValues {
+
+				if actual == value {
+					return true
+				}
+			}
+
+			return false
+		}, nil
+	}
+
+	return func(subject *FilterSubject) bool {
+
+		actual := attribute.stringValue(subject)
+
+		for _, value := range stringValues {
+
+			if strings.EqualFold(actual, value) {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+func (parser *filterParser) parseBetween(attribute *filterAttribute) (filterPredicate, error) {
+
+	if attribute.kind != intAttribute {
+		return nil, parser.fail("between needs a numeric attribute")
+	}
+
+	low, err := parser.parseInt()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !parser.current().is("and") {
+		return nil, parser.fail("expected 'and' but found " + parser.current().describe())
+	}
+
+	parser.next()
+
+	high, err := parser.parseInt()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return func(subject *FilterSubject) bool {
+
+		actual := attribute.intValue(subject)
+
+		return actual >= low && actual <= high
+	}, nil
+}
+
+func (parser *filterParser) parseInt() (int, error) {
+
+	if parser.current().kind != numberToken {
+		return 0, parser.fail("expected a number but found " + parser.current().describe())
+	}
+
+	token := parser.next()
+
+	value, err := strconv.Atoi(token.text)
+
+	if err != nil {
+		return 0, &FilterSyntaxError{Position: token.position, Reason: "number is out of range"}
+	}
+
+	return value, nil
+}
+
+func (parser *filterParser) parseString() (string, error) {
+
+	if parser.current().kind != stringToken {
+		return "", parser.fail("expected a string but found " + parser.current().describe())
+	}
+
+	return parser.next().text, nil
+}
+
+func compareInts(actual int, value int, operator string) bool {
+
+	switch operator {
+	case "=":
+		return actual == value
+	case "!=":
+		return actual != value
+	case "<":
+		return actual < value
+	case "<=":
+		return actual <= value
+	case ">":
+		return actual > value
+	default:
+		return actual >= value
+	}
+}
+
+// compareStrings compares case-insensitively, like the country and city filters
+func compareStrings(actual string, value string, operator string) bool {
+
+	actual, value = strings.ToLower(actual), strings.ToLower(value)
+
+	switch operator {
+	case "=":
+		return actual == value
+	case "!=":
+		return actual != value
+	case "<":
+		return actual < value
+	case "<=":
+		return actual <= value
+	case ">":
+		return actual > value
+	default:
+		return actual >= value
+	}
+}
+
+func andPredicate(left filterPredicate, right filterPredicate) filterPredicate {
+	return func(subject *FilterSubject) bool {
+		return left(subject) && right(subject)
+	}
+}
+
+func orPredicate(left filterPredicate, right filterPredicate) filterPredicate {
+	return func(subject *FilterSubject) bool {
+		return left(subject) || right(subject)
+	}
+}
+
+func notPredicate(operand filterPredicate) filterPredicate {
+	return func(subject *FilterSubject) bool {
+		return !operand(subject)
+	}
+}
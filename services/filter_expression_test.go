@@ -0,0 +1,143 @@
+package services
+
+import (
+	"hlcup_epoll/entities"
+	"testing"
+	"time"
+)
+
+func TestTokenizeFilter(t *testing.T) {
+
+	tokens, err := tokenizeFilter(`mark>=4 and (country!="Spa\"in", -12)`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantTokens := []filterToken{
+		{identToken, "mark", 1},
+		{operatorToken, ">=", 5},
+		{numberToken, "4", 7},
+		{identToken, "and", 9},
+		{openToken, "(", 13},
+		{identToken, "country", 14},
+		{operatorToken, "!=", 21},
+		{stringToken, `Spa"in`, 23},
+		{commaToken, ",", 32},
+		{numberToken, "-12", 34},
+		{closeToken, ")", 37},
+		{endToken, "", 38},
+	}
+
+	if len(tokens) != len(wantTokens) {
+		t.Fatalf("%d tokens, want %d", len(tokens), len(wantTokens))
+	}
+
+	for index, token := range tokens {
+
+		if *token != wantTokens[index] {
+			t.Errorf("token %d = %+v, want %+v", index, *token, wantTokens[index])
+		}
+	}
+}
+
+func TestCompileFilterExpression(t *testing.T) {
+
+	visitId, visitedAt, mark, userId, locationId := uint(7), 150, 4, uint(3), uint(9)
+	birthDate := int(time.Date(1990, 6, 1, 0, 0, 0, 0, time.UTC).Unix())
+	gender, email, firstName, lastName := "f", "anna@mail.ru", "Anna", "Petrova"
+	country, city, place, distance := "Spain", "Madrid", "Prado", uint(40)
+
+	subject := &FilterSubject{
+		Visit:              &entities.Visit{Id: &visitId, VisitedAt: &visitedAt, Mark: &mark, User: &userId, Location: &locationId},
+		User:               &entities.User{BirthDate: &birthDate, Gender: &gender, Email: &email, FirstName: &firstName, LastName: &lastName},
+		Location:           &entities.Location{Country: &country, City: &city, Place: &place, Distance: &distance},
+		timeDataGeneration: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	testCases := []struct {
+		expression string
+		wantMatch  bool
+	}{
+		{"mark=4", true},
+		{"mark!=4", false},
+		{"mark>=4 and mark<=4", true},
+		{"mark>4 or mark<4", false},
+		{"id=7 and user=3 and location=9", true},
+		{"visited_at between 100 and 150", true},
+		{"visited_at not between 100 and 150", false},
+		{"distance in (10, 40)", true},
+		{"distance not in (10, 20)", true},
+		{`country in ("russia", "SPAIN")`, true},
+		{`country="spain" and city!="Madrid"`, false},
+		{`not (gender="m" or place="Louvre")`, true},
+		{`NOT gender="f" OR email="anna@mail.ru"`, true},
+		{`first_name="Anna" and last_name>"P"`, true},
+		{"age between 35 and 35", true},
+		{"age >= 36", false},
+		{"birth_date<0", false},
+		{"mark=4 or mark=5 and mark=6", true},
+		{"(mark=4 or mark=5) and mark=6", false},
+	}
+
+	for _, testCase := range testCases {
+
+		filterExpression, err := CompileFilterExpression(testCase.expression)
+
+		if err != nil {
+			t.Errorf("%q: %v", testCase.expression, err)
+			continue
+		}
+
+		if isMatch := filterExpression.Match(subject); isMatch != testCase.wantMatch {
+			t.Errorf("%q: match = %v, want %v", testCase.expression, isMatch, testCase.wantMatch)
+		}
+	}
+}
+
+func TestCompileFilterExpressionErrors(t *testing.T) {
+
+	testCases := []struct {
+		expression   string
+		wantPosition int
+	}{
+		{"", 1},
+		{"mark", 5},
+		{"mark==4", 5},
+		{"mark!4", 5},
+		{"mark=", 6},
+		{"mark=-", 6},
+		{"mark=4 and", 11},
+		{"mark=4 mark=5", 8},
+		{"rating=4", 1},
+		{`mark="4"`, 6},
+		{"country=Spain", 9},
+		{`country="Spain`, 9},
+		{"country between 1 and 2", 17},
+		{"mark between 1 or 2", 16},
+		{"mark in 1", 9},
+		{"mark in (1 2)", 12},
+		{"mark in (1,", 12},
+		{"(mark=4", 8},
+		{"mark=4)", 7},
+		{"mark not =4", 10},
+		{"mark=99999999999999999999", 6},
+		{"mark=4 & mark=5", 8},
+	}
+
+	for _, testCase := range testCases {
+
+		_, err := CompileFilterExpression(testCase.expression)
+
+		filterSyntaxError, ok := err.(*FilterSyntaxError)
+
+		if !ok {
+			t.Errorf("%q: error = %v, want a syntax error", testCase.expression, err)
+			continue
+		}
+
+		if filterSyntaxError.Position != testCase.wantPosition {
+			t.Errorf("%q: %v, want position %d", testCase.expression, filterSyntaxError, testCase.wantPosition)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package services
+
+import (
+	"github.com/asaskevich/govalidator"
+	"hlcup_epoll/entities"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// FilterScope is the set of endpoints a filter is allowed on
+type FilterScope int
+
+const (
+	// ScopeUserVisits are the visited places of a user and the user aggregates
+	ScopeUserVisits FilterScope = 1 << iota
+	// ScopeLocationVisits are the visits of a location and the location, country and city aggregates
+	ScopeLocationVisits
+	// ScopeTopLocations are the filters of the locations ranked by the top, they are checked by the ranking itself
+	ScopeTopLocations
+)
+
+type UnknownParamPolicy int
+
+const (
+	// UnknownParamsIgnore skips the query parameters which are not filters of the endpoint
+	UnknownParamsIgnore UnknownParamPolicy = iota
+	// UnknownParamsReject answers 400 to them
+	UnknownParamsReject
+)
+
+// reservedParams are the query parameters which are not filters but are read by the handlers themselves
+var reservedParams = map[string]bool{
+	"query_id": true, "filter": true, "limit": true, "offset": true, "cursor": true, "sort": true, "order": true,
+	"fields": true, "expand": true, "include": true, "bucket": true, "ageBuckets": true, "by": true, "minVisits": true,
+	"explain": true,
+}
+
+// FilterValues are the parsed values of a query parameter, Ints for numeric filters and Strings otherwise
+type FilterValues struct {
+	Ints    []int
+	Strings []string
+}
+
+// FilterDefinition declares one query parameter filter: how its value is validated,
+// how it is stored in VisitsFilter and how a visit is checked against it
+type FilterDefinition struct {
+	Name      string
+	Type      entities.FieldType
+	Multiple  bool
+	MaxLength int
+	Enum      []string
+	Validate  func(value string) string
+	Scopes    FilterScope
+	Set       func(visitFilter *VisitsFilter, values *FilterValues)
+	Check     func(visitFilter *VisitsFilter, subject *FilterSubject) bool
+}
+
+// defaultFilterRegistry checks the filters which are not set by a registry
+var defaultFilterRegistry = NewFilterRegistry(UnknownParamsIgnore)
+
+type FilterRegistry struct {
+	definitions        []*FilterDefinition
+	definitionsByName  map[string]*FilterDefinition
+	unknownParamPolicy UnknownParamPolicy
+}
+
+func NewFilterRegistry(unknownParamPolicy UnknownParamPolicy) *FilterRegistry {
+
+	filterRegistry := &FilterRegistry{definitionsByName: make(map[string]*FilterDefinition), unknownParamPolicy: unknownParamPolicy}
+
+	for _, filterDefinition := range visitsFilterDefinitions {
+		filterRegistry.Register(filterDefinition)
+	}
+
+	return filterRegistry
+}
+
+func (filterRegistry *FilterRegistry) Register(filterDefinition *FilterDefinition) {
+
+	filterRegistry.definitions = append(filterRegistry.definitions, filterDefinition)
+	filterRegistry.definitionsByName[filterDefinition.Name] = filterDefinition
+}
+
+// Parse validates the query parameters of an endpoint and sets the filters they declare
+func (filterRegistry *FilterRegistry) Parse(query url.Values, scope FilterScope, visitFilter *VisitsFilter) []*entities.FieldError {
+
+	var fieldErrors []*entities.FieldError
+
+	for name, values := range query {
+
+		filterDefinition, ok := filterRegistry.definitionsByName[name]
+
+		if !ok || filterDefinition.Scopes&scope == 0 {
+
+			if filterRegistry.unknownParamPolicy == UnknownParamsReject && !reservedParams[name] {
+				fieldErrors = append(fieldErrors, &entities.FieldError{Field: name, Reason: "is not a filter of this endpoint"})
+			}
+
+			continue
+		}
+
+		if !filterDefinition.Multiple {
+			values = values[:1]
+		}
+
+		filterValues, reason := filterDefinition.parse(values)
+
+		if reason != "" {
+			fieldErrors = append(fieldErrors, &entities.FieldError{Field: name, Reason: reason})
+			continue
+		}
+
+		filterDefinition.Set(visitFilter, filterValues)
+		visitFilter.Profile.AddFilter(name, values)
+	}
+
+	visitFilter.registry = filterRegistry
+
+	return fieldErrors
+}
+
+// Match checks a visit against every filter of the scope, unset filters match everything
+func (filterRegistry *FilterRegistry) Match(visitFilter *VisitsFilter, scope FilterScope, subject *FilterSubject) bool {
+
+	for _, filterDefinition := range filterRegistry.definitions {
+
+		if filterDefinition.Scopes&scope != 0 && !filterDefinition.Check(visitFilter, subject) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (filterDefinition *FilterDefinition) parse(values []string) (*FilterValues, string) {
+
+	filterValues := new(FilterValues)
+
+	for _, value := range values {
+
+		if value == "" {
+			return nil, "must not be empty"
+		}
+
+		if filterDefinition.Type != entities.StringField {
+
+			if !govalidator.IsNumeric(value) {
+				return nil, "must be a non-negative integer"
+			}
+
+			intValue, err := strconv.Atoi(value)
+
+			if err != nil {
+				return nil, "is out of range"
+			}
+
+			filterValues.Ints = append(filterValues.Ints, intValue)
+
+			continue
+		}
+
+		if filterDefinition.MaxLength != 0 && len(value) > filterDefinition.MaxLength {
+			return nil, "must be at most " + strconv.Itoa(filterDefinition.MaxLength) + " characters"
+		}
+
+		if len(filterDefinition.Enum) != 0 && !isOneOf(value, filterDefinition.Enum) {
+			return nil, "must be one of [" + strings.Join(filterDefinition.Enum, " ") + "]"
+		}
+
+		if filterDefinition.Validate != nil {
+
+			if reason := filterDefinition.Validate(value); reason != "" {
+				return nil, reason
+			}
+		}
+
+		filterValues.Strings = append(filterValues.Strings, value)
+	}
+
+	return filterValues, ""
+}
+
+func isOneOf(value string, allowedValues []string) bool {
+
+	for _, allowedValue := range allowedValues {
+
+		if value == allowedValue {
+			return true
+		}
+	}
+
+	return false
+}
+
+var visitsFilterDefinitions = []*FilterDefinition{
+	{
+		Name:   "fromDate",
+		Type:   entities.IntField,
+		Scopes: ScopeUserVisits | ScopeLocationVisits,
+		Set:    func(visitFilter *VisitsFilter, values *FilterValues) { visitFilter.FromDate = &values.Ints[0] },
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckFromDate(*subject.Visit.VisitedAt)
+		},
+	},
+	{
+		Name:   "toDate",
+		Type:   entities.IntField,
+		Scopes: ScopeUserVisits | ScopeLocationVisits,
+		Set:    func(visitFilter *VisitsFilter, values *FilterValues) { visitFilter.ToDate = &values.Ints[0] },
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckToDate(*subject.Visit.VisitedAt)
+		},
+	},
+	{
+		Name:   "fromMark",
+		Type:   entities.IntField,
+		Scopes: ScopeUserVisits | ScopeLocationVisits,
+		Set:    func(visitFilter *VisitsFilter, values *FilterValues) { visitFilter.FromMark = &values.Ints[0] },
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckFromMark(*subject.Visit.Mark)
+		},
+	},
+	{
+		Name:   "toMark",
+		Type:   entities.IntField,
+		Scopes: ScopeUserVisits | ScopeLocationVisits,
+		Set:    func(visitFilter *VisitsFilter, values *FilterValues) { visitFilter.ToMark = &values.Ints[0] },
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckToMark(*subject.Visit.Mark)
+		},
+	},
+	{
+		Name:   "fromDistance",
+		Type:   entities.UintField,
+		Scopes: ScopeUserVisits,
+		Set: func(visitFilter *VisitsFilter, values *FilterValues) {
+			fromDistance := uint(values.Ints[0])
+			visitFilter.FromDistance = &fromDistance
+		},
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckFromDistance(*subject.Location.Distance)
+		},
+	},
+	{
+		Name:   "toDistance",
+		Type:   entities.UintField,
+		Scopes: ScopeUserVisits,
+		Set: func(visitFilter *VisitsFilter, values *FilterValues) {
+			toDistance := uint(values.Ints[0])
+			visitFilter.ToDistance = &toDistance
+		},
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckToDistance(*subject.Location.Distance)
+		},
+	},
+	{
+		Name:      "country",
+		Type:      entities.StringField,
+		Multiple:  true,
+		MaxLength: 50,
+		Scopes:    ScopeUserVisits | ScopeTopLocations,
+		Set:       func(visitFilter *VisitsFilter, values *FilterValues) { visitFilter.Countries = values.Strings },
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckCountry(*subject.Location.Country)
+		},
+	},
+	{
+		Name:      "city",
+		Type:      entities.StringField,
+		MaxLength: 50,
+		Scopes:    ScopeUserVisits | ScopeTopLocations,
+		Set:       func(visitFilter *VisitsFilter, values *FilterValues) { visitFilter.City = &values.Strings[0] },
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckCity(*subject.Location.City)
+		},
+	},
+	{
+		Name:   "fromAge",
+		Type:   entities.IntField,
+		Scopes: ScopeLocationVisits,
+		Set:    func(visitFilter *VisitsFilter, values *FilterValues) { visitFilter.FromAge = &values.Ints[0] },
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckFromAge(*subject.User.BirthDate)
+		},
+	},
+	{
+		Name:   "toAge",
+		Type:   entities.IntField,
+		Scopes: ScopeLocationVisits,
+		Set:    func(visitFilter *VisitsFilter, values *FilterValues) { visitFilter.ToAge = &values.Ints[0] },
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckToAge(*subject.User.BirthDate)
+		},
+	},
+	{
+		Name:   "gender",
+		Type:   entities.StringField,
+		Enum:   []string{"m", "f"},
+		Scopes: ScopeLocationVisits,
+		Set:    func(visitFilter *VisitsFilter, values *FilterValues) { visitFilter.Gender = &values.Strings[0] },
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckGender(*subject.User.Gender)
+		},
+	},
+	{
+		Name:      "emailDomain",
+		Type:      entities.StringField,
+		MaxLength: 100,
+		Validate: func(value string) string {
+
+			if strings.Contains(value, "@") {
+				return "must not contain @"
+			}
+
+			return ""
+		},
+		Scopes: ScopeLocationVisits,
+		Set:    func(visitFilter *VisitsFilter, values *FilterValues) { visitFilter.EmailDomain = &values.Strings[0] },
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckEmailDomain(*subject.User.Email)
+		},
+	},
+	{
+		Name:      "lastNamePrefix",
+		Type:      entities.StringField,
+		MaxLength: 50,
+		Scopes:    ScopeLocationVisits,
+		Set:       func(visitFilter *VisitsFilter, values *FilterValues) { visitFilter.LastNamePrefix = &values.Strings[0] },
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckLastNamePrefix(*subject.User.LastName)
+		},
+	},
+	{
+		Name:     "exclude_user",
+		Type:     entities.UintField,
+		Multiple: true,
+		Scopes:   ScopeLocationVisits,
+		Set: func(visitFilter *VisitsFilter, values *FilterValues) {
+
+			for _, userId := range values.Ints {
+				visitFilter.ExcludedUsers = append(visitFilter.ExcludedUsers, uint(userId))
+			}
+		},
+		Check: func(visitFilter *VisitsFilter, subject *FilterSubject) bool {
+			return visitFilter.CheckExcludedUser(*subject.Visit.User)
+		},
+	},
+}
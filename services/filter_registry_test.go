@@ -0,0 +1,126 @@
+package services
+
+import (
+	"hlcup_epoll/entities"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fieldNames(fieldErrors []*entities.FieldError) string {
+
+	names := make([]string, 0, len(fieldErrors))
+
+	for _, fieldError := range fieldErrors {
+		names = append(names, fieldError.Field)
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+func TestFilterRegistryParse(t *testing.T) {
+
+	testCases := []struct {
+		query      string
+		scope      FilterScope
+		policy     UnknownParamPolicy
+		wantErrors string
+	}{
+		{"fromDate=10&toDate=20&country=Spain&country=France", ScopeUserVisits, UnknownParamsReject, ""},
+		{"fromDate=abc", ScopeUserVisits, UnknownParamsIgnore, "fromDate"},
+		{"fromDate=-1", ScopeUserVisits, UnknownParamsIgnore, "fromDate"},
+		{"fromDate=", ScopeUserVisits, UnknownParamsIgnore, "fromDate"},
+		{"fromMark=99999999999999999999", ScopeUserVisits, UnknownParamsIgnore, "fromMark"},
+		{"gender=x", ScopeLocationVisits, UnknownParamsIgnore, "gender"},
+		{"emailDomain=a@b.ru", ScopeLocationVisits, UnknownParamsIgnore, "emailDomain"},
+		{"city=" + strings.Repeat("a", 51), ScopeUserVisits, UnknownParamsIgnore, "city"},
+		{"gender=m&unknown=1", ScopeLocationVisits, UnknownParamsIgnore, ""},
+		{"gender=m&unknown=1", ScopeLocationVisits, UnknownParamsReject, "unknown"},
+		{"gender=m", ScopeUserVisits, UnknownParamsIgnore, ""},
+		{"gender=m", ScopeUserVisits, UnknownParamsReject, "gender"},
+		{"country=Spain&by=visits&minVisits=2&limit=3", ScopeTopLocations, UnknownParamsReject, ""},
+		{"fromDate=1", ScopeTopLocations, UnknownParamsReject, "fromDate"},
+		{"limit=1&offset=1&sort=mark&order=asc&fields=mark&explain=1&query_id=1", ScopeUserVisits, UnknownParamsReject, ""},
+		{"toAge=x&fromAge=y&nope=1", ScopeLocationVisits, UnknownParamsReject, "fromAge,nope,toAge"},
+	}
+
+	for _, testCase := range testCases {
+
+		query, err := url.ParseQuery(testCase.query)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filter := InitVisitFilter(time.Unix(0, 0))
+
+		fieldErrors := NewFilterRegistry(testCase.policy).Parse(query, testCase.scope, filter)
+
+		if gotErrors := fieldNames(fieldErrors); gotErrors != testCase.wantErrors {
+			t.Errorf("%q: errors on %q, want %q", testCase.query, gotErrors, testCase.wantErrors)
+		}
+	}
+}
+
+func TestFilterRegistryMatch(t *testing.T) {
+
+	visitedAt, mark, userId := 150, 4, uint(3)
+	birthDate := int(time.Date(1990, 6, 1, 0, 0, 0, 0, time.UTC).Unix())
+	gender, email, lastName := "f", "anna@mail.ru", "Petrova"
+	country, city, distance := "Spain", "Madrid", uint(40)
+
+	subject := &FilterSubject{
+		Visit:    &entities.Visit{VisitedAt: &visitedAt, Mark: &mark, User: &userId},
+		User:     &entities.User{BirthDate: &birthDate, Gender: &gender, Email: &email, LastName: &lastName},
+		Location: &entities.Location{Country: &country, City: &city, Distance: &distance},
+	}
+
+	testCases := []struct {
+		query     string
+		scope     FilterScope
+		wantMatch bool
+	}{
+		{"", ScopeUserVisits, true},
+		{"fromDate=100&toDate=200", ScopeUserVisits, true},
+		{"fromDate=150", ScopeUserVisits, false},
+		{"toDate=150", ScopeUserVisits, false},
+		{"fromMark=3&toMark=5", ScopeLocationVisits, true},
+		{"fromMark=4", ScopeLocationVisits, false},
+		{"toMark=4", ScopeLocationVisits, false},
+		{"country=france&country=spain", ScopeUserVisits, true},
+		{"country=France", ScopeUserVisits, false},
+		{"country=France", ScopeTopLocations, false},
+		{"city=Madrid", ScopeTopLocations, true},
+		{"toDistance=40", ScopeUserVisits, false},
+		{"fromDistance=39&toDistance=41", ScopeUserVisits, true},
+		{"gender=f&emailDomain=mail.ru&lastNamePrefix=Pet", ScopeLocationVisits, true},
+		{"gender=m", ScopeLocationVisits, false},
+		{"exclude_user=1&exclude_user=3", ScopeLocationVisits, false},
+		{"fromAge=30&toAge=40", ScopeLocationVisits, true},
+		{"fromAge=40", ScopeLocationVisits, false},
+	}
+
+	generation := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, testCase := range testCases {
+
+		query, _ := url.ParseQuery(testCase.query)
+
+		filter := InitVisitFilter(generation)
+
+		fieldErrors := NewFilterRegistry(UnknownParamsReject).Parse(query, testCase.scope, filter)
+
+		if len(fieldErrors) != 0 {
+			t.Errorf("%q: unexpected errors %q", testCase.query, fieldNames(fieldErrors))
+			continue
+		}
+
+		if isMatch := filter.Match(testCase.scope, subject); isMatch != testCase.wantMatch {
+			t.Errorf("%q: match = %v, want %v", testCase.query, isMatch, testCase.wantMatch)
+		}
+	}
+}
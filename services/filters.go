@@ -14,25 +14,69 @@ type VisitsFilter struct {
 	UserId             Uint
 	FromDate           Int
 	ToDate             Int
-	Country            String
+	Countries          []string
+	City               String
+	FromDistance       Uint
 	ToDistance         Uint
+	FromMark           Int
+	ToMark             Int
 	FromAge            Int
 	ToAge              Int
 	Gender             String
+	EmailDomain        String
+	LastNamePrefix     String
+	ExcludedUsers      []uint
 	LocationId         Uint
+	Expression         *FilterExpression
+	registry           *FilterRegistry
+	Profile            *QueryProfile
 }
 
 func InitVisitFilter(timeDataGeneration time.Time) *VisitsFilter {
 	return &VisitsFilter{timeDataGeneration: timeDataGeneration}
 }
 
+// Match checks a visit against the filters of the scope and the filter expression
+func (visitFilter *VisitsFilter) Match(scope FilterScope, subject *FilterSubject) bool {
+
+	registry := visitFilter.registry
+
+	if registry == nil {
+		registry = defaultFilterRegistry
+	}
+
+	subject.timeDataGeneration = visitFilter.timeDataGeneration
+
+	if !registry.Match(visitFilter, scope, subject) {
+		return false
+	}
+
+	return visitFilter.Expression == nil || visitFilter.Expression.Match(subject)
+}
+
 func (visitFilter *VisitsFilter) CheckCountry(country string) bool {
 
-	if visitFilter.Country == nil {
+	if len(visitFilter.Countries) == 0 {
+		return true
+	}
+
+	for _, filterCountry := range visitFilter.Countries {
+
+		if strings.ToLower(country) == strings.ToLower(filterCountry) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (visitFilter *VisitsFilter) CheckCity(city string) bool {
+
+	if visitFilter.City == nil {
 		return true
 	}
 
-	return strings.ToLower(country) == strings.ToLower(*visitFilter.Country)
+	return strings.ToLower(city) == strings.ToLower(*visitFilter.City)
 }
 
 func (visitFilter *VisitsFilter) CheckFromDate(visitedAt int) bool {
@@ -62,6 +106,33 @@ func (visitFilter *VisitsFilter) CheckToDistance(toDistance uint) bool {
 	return toDistance < *visitFilter.ToDistance
 }
 
+func (visitFilter *VisitsFilter) CheckFromDistance(fromDistance uint) bool {
+
+	if visitFilter.FromDistance == nil {
+		return true
+	}
+
+	return fromDistance > *visitFilter.FromDistance
+}
+
+func (visitFilter *VisitsFilter) CheckFromMark(mark int) bool {
+
+	if visitFilter.FromMark == nil {
+		return true
+	}
+
+	return mark > *visitFilter.FromMark
+}
+
+func (visitFilter *VisitsFilter) CheckToMark(mark int) bool {
+
+	if visitFilter.ToMark == nil {
+		return true
+	}
+
+	return mark < *visitFilter.ToMark
+}
+
 func (visitFilter *VisitsFilter) CheckFromAge(birthDate int) bool {
 
 	if visitFilter.FromAge == nil {
@@ -88,3 +159,35 @@ func (visitFilter *VisitsFilter) CheckGender(gender string) bool {
 
 	return gender == *visitFilter.Gender
 }
+
+func (visitFilter *VisitsFilter) CheckEmailDomain(email string) bool {
+
+	if visitFilter.EmailDomain == nil {
+		return true
+	}
+
+	atIndex := strings.LastIndex(email, "@")
+
+	return atIndex != -1 && strings.ToLower(email[atIndex+1:]) == strings.ToLower(*visitFilter.EmailDomain)
+}
+
+func (visitFilter *VisitsFilter) CheckLastNamePrefix(lastName string) bool {
+
+	if visitFilter.LastNamePrefix == nil {
+		return true
+	}
+
+	return strings.HasPrefix(strings.ToLower(lastName), strings.ToLower(*visitFilter.LastNamePrefix))
+}
+
+func (visitFilter *VisitsFilter) CheckExcludedUser(userId uint) bool {
+
+	for _, excludedUserId := range visitFilter.ExcludedUsers {
+
+		if userId == excludedUserId {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"time"
+)
+
+type queryProfileKey struct{}
+
+// QueryProfile collects what the visits queries of one request did, it is requested with explain=1 or the X-Explain header
+type QueryProfile struct {
+	Indexes  []string            `json:"indexes"`
+	Scanned  int                 `json:"scanned"`
+	Matched  int                 `json:"matched"`
+	Decoded  int                 `json:"decoded"`
+	Phases   []*QueryPhase       `json:"phases"`
+	Filters  map[string][]string `json:"filters,omitempty"`
+	attached bool
+}
+
+// QueryPhase is the time spent in one phase, summed over every query of the request
+type QueryPhase struct {
+	Name       string `json:"name"`
+	DurationUs int64  `json:"duration_us"`
+}
+
+func NewQueryProfile() *QueryProfile {
+	return &QueryProfile{Indexes: make([]string, 0), Phases: make([]*QueryPhase, 0)}
+}
+
+func WithQueryProfile(ctx context.Context, queryProfile *QueryProfile) context.Context {
+	return context.WithValue(ctx, queryProfileKey{}, queryProfile)
+}
+
+// QueryProfileFrom returns the profile of the request, nil when it is not explained
+func QueryProfileFrom(ctx context.Context) *QueryProfile {
+
+	queryProfile, _ := ctx.Value(queryProfileKey{}).(*QueryProfile)
+
+	return queryProfile
+}
+
+// Attach marks the profile as used by a visits query, a profile of any other request is not returned
+func (queryProfile *QueryProfile) Attach() {
+
+	if queryProfile != nil {
+		queryProfile.attached = true
+	}
+}
+
+func (queryProfile *QueryProfile) IsAttached() bool {
+	return queryProfile != nil && queryProfile.attached
+}
+
+// AddFilter records a parsed filter parameter
+func (queryProfile *QueryProfile) AddFilter(name string, values []string) {
+
+	if queryProfile == nil {
+		return
+	}
+
+	if queryProfile.Filters == nil {
+		queryProfile.Filters = make(map[string][]string)
+	}
+
+	queryProfile.Filters[name] = values
+}
+
+func (queryProfile *QueryProfile) UseIndex(name string) {
+
+	if queryProfile == nil {
+		return
+	}
+
+	for _, index := range queryProfile.Indexes {
+
+		if index == name {
+			return
+		}
+	}
+
+	queryProfile.Indexes = append(queryProfile.Indexes, name)
+}
+
+func (queryProfile *QueryProfile) Scan() {
+
+	if queryProfile != nil {
+		queryProfile.Scanned++
+	}
+}
+
+func (queryProfile *QueryProfile) Match() {
+
+	if queryProfile != nil {
+		queryProfile.Matched++
+	}
+}
+
+func (queryProfile *QueryProfile) Decode() {
+
+	if queryProfile != nil {
+		queryProfile.Decoded++
+	}
+}
+
+// Phase starts timing a phase, the returned function ends it
+func (queryProfile *QueryProfile) Phase(name string) func() {
+
+	if queryProfile == nil {
+		return func() {}
+	}
+
+	startTime := time.Now()
+
+	return func() {
+
+		duration := time.Since(startTime).Nanoseconds() / int64(time.Microsecond)
+
+		for _, phase := range queryProfile.Phases {
+
+			if phase.Name == name {
+				phase.DurationUs += duration
+				return
+			}
+		}
+
+		queryProfile.Phases = append(queryProfile.Phases, &QueryPhase{Name: name, DurationUs: duration})
+	}
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"github.com/json-iterator/go"
+	"hlcup_epoll/entities"
+)
+
+// ReferenceStrictness defines how visits with unknown users or locations are treated after a bulk load.
+// Visits written through the API are always checked.
+type ReferenceStrictness int
+
+const (
+	// ReferencesLenient keeps dangling visits and only reports them
+	ReferencesLenient ReferenceStrictness = iota
+	// ReferencesDrop deletes dangling visits
+	ReferencesDrop
+	// ReferencesStrict stops the loading
+	ReferencesStrict
+)
+
+var ErrUnknownUser = errors.New("user does not exist")
+var ErrUnknownLocation = errors.New("location does not exist")
+
+// CheckReferences must be called once the archive is loaded: files are processed concurrently,
+// so the users and locations of a visit may be loaded after the visit itself
+func (storage *Storage) CheckReferences() {
+
+	danglingVisitsIds := make([]uint, 0)
+
+	for _, visitId := range storage.visitIndexByID.GetIds() {
+
+		visitBytes := storage.GetVisitById(visitId)
+
+		if visitBytes == nil {
+			continue
+		}
+
+		visit := new(entities.Visit)
+
+		err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(visitBytes, visit)
+
+		if err != nil {
+			storage.errorLogger.Fatalln(err)
+		}
+
+		if storage.checkVisitReferences(visit) != nil {
+			danglingVisitsIds = append(danglingVisitsIds, visitId)
+		}
+	}
+
+	if len(danglingVisitsIds) == 0 {
+		return
+	}
+
+	switch storage.referenceStrictness {
+	case ReferencesStrict:
+		storage.errorLogger.Fatalln(fmt.Sprintf("%d visits reference unknown users or locations", len(danglingVisitsIds)))
+	case ReferencesDrop:
+		for _, visitId := range danglingVisitsIds {
+			storage.DeleteVisit(visitId)
+		}
+
+		storage.infoLogger.Println(fmt.Sprintf("%d visits with unknown users or locations are dropped", len(danglingVisitsIds)))
+	default:
+		storage.infoLogger.Println(fmt.Sprintf("%d visits reference unknown users or locations", len(danglingVisitsIds)))
+	}
+}
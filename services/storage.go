@@ -3,15 +3,15 @@ package services
 import (
 	"archive/zip"
 	"fmt"
+	"github.com/json-iterator/go"
 	"hlcup_epoll/entities"
 	"hlcup_epoll/indexes"
 	"io/ioutil"
 	"log"
+	"sort"
 	"strings"
 	"sync"
 	"time"
-	"sort"
-	"github.com/json-iterator/go"
 )
 
 type Storage struct {
@@ -23,6 +23,12 @@ type Storage struct {
 	userIndexByEmail       *indexes.UserIndexByEmail
 	visitIndexByLocationID *indexes.VisitIndexByLocationId
 	visitIndexByUserID     *indexes.VisitIndexByUserId
+	locationIndexByCountry *indexes.LocationIndexByCountry
+	locationIndexByCity    *indexes.LocationIndexByCity
+	visitStatsIndexByUser  *indexes.VisitStatsIndexByUserId
+	locationMutex          *sync.Mutex
+	cascadePolicy          CascadePolicy
+	referenceStrictness    ReferenceStrictness
 }
 
 func NewStorage(errorLogger *log.Logger, infoLogger *log.Logger) *Storage {
@@ -36,9 +42,25 @@ func NewStorage(errorLogger *log.Logger, infoLogger *log.Logger) *Storage {
 		userIndexByEmail:       indexes.NewUserIndexByEmail(),
 		visitIndexByLocationID: indexes.NewVisitIndexByLocationId(),
 		visitIndexByUserID:     indexes.NewVisitIndexByUserId(),
+		locationIndexByCountry: indexes.NewLocationIndexByCountry(),
+		locationIndexByCity:    indexes.NewLocationIndexByCity(),
+		visitStatsIndexByUser:  indexes.NewVisitStatsIndexByUserId(),
+		locationMutex:          new(sync.Mutex),
+		cascadePolicy:          CascadeReject,
+		referenceStrictness:    ReferencesLenient,
 	}
 }
 
+func (storage *Storage) SetCascadePolicy(cascadePolicy CascadePolicy) {
+
+	storage.cascadePolicy = cascadePolicy
+}
+
+func (storage *Storage) SetReferenceStrictness(referenceStrictness ReferenceStrictness) {
+
+	storage.referenceStrictness = referenceStrictness
+}
+
 func (storage *Storage) Init(pathToArchive string, countConcurrentFiles int, waitGroup *sync.WaitGroup) {
 
 	waitGroup.Add(countConcurrentFiles)
@@ -103,6 +125,7 @@ func (storage *Storage) Init(pathToArchive string, countConcurrentFiles int, wai
 						storage.AddVisit(visit)
 						storage.AddVisitByLocationId(visit)
 						storage.AddVisitByUserId(visit)
+						storage.visitStatsIndexByUser.AddVisit(visit)
 					}
 				}
 
@@ -168,13 +191,35 @@ func (storage *Storage) AddUser(user *entities.User) {
 	storage.userIndexByEmail.AddEmail(*user.Email)
 }
 
+// AddLocation stores the location and moves it between the country and city indexes,
+// the updates of locations are serialized so that the replaced location is the one indexed before
 func (storage *Storage) AddLocation(location *entities.Location) {
 
-	err := storage.locationIndexByID.AddLocation(location)
+	storage.locationMutex.Lock()
+	defer storage.locationMutex.Unlock()
+
+	oldLocationBytes, err := storage.locationIndexByID.AddLocation(location)
 
 	if err != nil {
 		storage.errorLogger.Fatalln(err)
 	}
+
+	if oldLocationBytes != nil {
+
+		oldLocation := new(entities.Location)
+
+		err = jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(oldLocationBytes, oldLocation)
+
+		if err != nil {
+			storage.errorLogger.Fatalln(err)
+		}
+
+		storage.locationIndexByCountry.DeleteLocation(*oldLocation.Country, *oldLocation.Id)
+		storage.locationIndexByCity.DeleteLocation(*oldLocation.City, *oldLocation.Id)
+	}
+
+	storage.locationIndexByCountry.AddLocation(*location.Country, *location.Id)
+	storage.locationIndexByCity.AddLocation(*location.City, *location.Id)
 }
 
 func (storage *Storage) AddVisit(visit *entities.Visit) {
@@ -194,6 +239,75 @@ func (storage *Storage) AddVisitByLocationId(visit *entities.Visit) {
 	storage.visitIndexByLocationID.AddVisit(visit)
 }
 
+func (storage *Storage) CreateVisit(visit *entities.Visit) error {
+
+	err := storage.checkVisitReferences(visit)
+
+	if err != nil {
+		return err
+	}
+
+	storage.AddVisit(visit)
+	storage.AddVisitByUserId(visit)
+	storage.AddVisitByLocationId(visit)
+	storage.visitStatsIndexByUser.AddVisit(visit)
+
+	return nil
+}
+
+func (storage *Storage) UpdateVisit(visit *entities.Visit) error {
+
+	oldVisitBytes := storage.GetVisitById(*visit.Id)
+
+	if oldVisitBytes == nil {
+		return ErrEntityNotFound
+	}
+
+	err := storage.checkVisitReferences(visit)
+
+	if err != nil {
+		return err
+	}
+
+	oldVisit := new(entities.Visit)
+
+	err = jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(oldVisitBytes, oldVisit)
+
+	if err != nil {
+		storage.errorLogger.Fatalln(err)
+	}
+
+	if *visit.Location != *oldVisit.Location {
+		storage.DeleteVisitFromLocation(*oldVisit.Location, *visit.Id)
+		storage.AddVisitByLocationId(visit)
+	}
+
+	if *visit.User != *oldVisit.User {
+		storage.DeleteVisitFromUser(*oldVisit.User, *visit.Id)
+		storage.AddVisitByUserId(visit)
+	}
+
+	storage.visitStatsIndexByUser.DeleteVisit(oldVisit)
+	storage.visitStatsIndexByUser.AddVisit(visit)
+
+	storage.AddVisit(visit)
+
+	return nil
+}
+
+func (storage *Storage) checkVisitReferences(visit *entities.Visit) error {
+
+	if storage.GetUserById(*visit.User) == nil {
+		return ErrUnknownUser
+	}
+
+	if storage.GetLocationById(*visit.Location) == nil {
+		return ErrUnknownLocation
+	}
+
+	return nil
+}
+
 func (storage *Storage) GetUserById(userId uint) []byte {
 
 	return storage.userIndexByID.GetUser(userId)
@@ -209,6 +323,91 @@ func (storage *Storage) GetVisitById(visitId uint) []byte {
 	return storage.visitIndexByID.GetVisit(visitId)
 }
 
+// GetIndexSizes returns the count of keys of every index by its name
+func (storage *Storage) GetIndexSizes() map[string]int {
+
+	return map[string]int{
+		"user_by_id":           storage.userIndexByID.Count(),
+		"location_by_id":       storage.locationIndexByID.Count(),
+		"visit_by_id":          storage.visitIndexByID.Count(),
+		"user_by_email":        storage.userIndexByEmail.Count(),
+		"visit_by_location_id": storage.visitIndexByLocationID.Count(),
+		"visit_by_user_id":     storage.visitIndexByUserID.Count(),
+		"location_by_country":  storage.locationIndexByCountry.Count(),
+		"location_by_city":     storage.locationIndexByCity.Count(),
+	}
+}
+
+func (storage *Storage) SnapshotUsers(fromId uint, toId uint) *indexes.Snapshot {
+
+	return storage.userIndexByID.Snapshot(fromId, toId)
+}
+
+func (storage *Storage) SnapshotLocations(fromId uint, toId uint) *indexes.Snapshot {
+
+	return storage.locationIndexByID.Snapshot(fromId, toId)
+}
+
+func (storage *Storage) SnapshotVisits(fromId uint, toId uint) *indexes.Snapshot {
+
+	return storage.visitIndexByID.Snapshot(fromId, toId)
+}
+
+func (storage *Storage) GetCountries() []string {
+
+	return storage.locationIndexByCountry.GetNames()
+}
+
+func (storage *Storage) GetLocationsByCountry(country string) []uint {
+
+	return storage.locationIndexByCountry.GetLocations(country)
+}
+
+func (storage *Storage) GetLocationsByCity(city string) []uint {
+
+	return storage.locationIndexByCity.GetLocations(city)
+}
+
+// GetVisitStatsByUser returns the visit count, the sum of marks and the last visit of a user without scanning its visits,
+// unless the last visit was removed since the previous call
+func (storage *Storage) GetVisitStatsByUser(userId uint) indexes.VisitStats {
+
+	visitStats, isStale := storage.visitStatsIndexByUser.GetStats(userId)
+
+	if !isStale {
+		return visitStats
+	}
+
+	var lastVisitAt *int
+
+	for _, visitId := range storage.visitIndexByUserID.GetVisits(userId) {
+
+		visitBytes := storage.GetVisitById(visitId)
+
+		if visitBytes == nil {
+			continue
+		}
+
+		visit := new(entities.Visit)
+
+		err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(visitBytes, visit)
+
+		if err != nil {
+			storage.errorLogger.Fatalln(err)
+		}
+
+		if lastVisitAt == nil || *visit.VisitedAt > *lastVisitAt {
+			lastVisitAt = visit.VisitedAt
+		}
+	}
+
+	storage.visitStatsIndexByUser.SetLastVisitAt(userId, visitStats, lastVisitAt)
+
+	visitStats.LastVisitAt = lastVisitAt
+
+	return visitStats
+}
+
 func (storage *Storage) DeleteVisitFromLocation(locationId uint, visitId uint) {
 
 	storage.visitIndexByLocationID.DeleteVisit(locationId, visitId)
@@ -224,64 +423,215 @@ func (storage *Storage) DeleteEmail(email string) {
 	storage.userIndexByEmail.DeleteEmail(email)
 }
 
+func (storage *Storage) DeleteUser(userId uint) error {
+
+	userBytes := storage.GetUserById(userId)
+
+	if userBytes == nil {
+		return ErrEntityNotFound
+	}
+
+	user := new(entities.User)
+
+	err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(userBytes, user)
+
+	if err != nil {
+		storage.errorLogger.Fatalln(err)
+	}
+
+	visitsIds := storage.visitIndexByUserID.GetVisits(userId)
+
+	if len(visitsIds) != 0 {
+
+		switch storage.cascadePolicy {
+		case CascadeReject:
+			return ErrEntityHasVisits
+		case CascadeDelete:
+			for _, visitId := range append([]uint(nil), visitsIds...) {
+				storage.DeleteVisit(visitId)
+			}
+		}
+	}
+
+	storage.visitIndexByUserID.DeleteUser(userId)
+	storage.visitStatsIndexByUser.DeleteUser(userId)
+	storage.userIndexByEmail.DeleteEmail(*user.Email)
+	storage.userIndexByID.DeleteUser(userId)
+
+	return nil
+}
+
+func (storage *Storage) DeleteLocation(locationId uint) error {
+
+	locationBytes := storage.GetLocationById(locationId)
+
+	if locationBytes == nil {
+		return ErrEntityNotFound
+	}
+
+	visitsIds := storage.visitIndexByLocationID.GetVisits(locationId)
+
+	if len(visitsIds) != 0 {
+
+		switch storage.cascadePolicy {
+		case CascadeReject:
+			return ErrEntityHasVisits
+		case CascadeDelete:
+			for _, visitId := range append([]uint(nil), visitsIds...) {
+				storage.DeleteVisit(visitId)
+			}
+		}
+	}
+
+	location := new(entities.Location)
+
+	err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(locationBytes, location)
+
+	if err != nil {
+		storage.errorLogger.Fatalln(err)
+	}
+
+	storage.locationIndexByCountry.DeleteLocation(*location.Country, locationId)
+	storage.locationIndexByCity.DeleteLocation(*location.City, locationId)
+	storage.visitIndexByLocationID.DeleteLocation(locationId)
+	storage.locationIndexByID.DeleteLocation(locationId)
+
+	return nil
+}
+
+func (storage *Storage) DeleteVisit(visitId uint) error {
+
+	visitBytes := storage.GetVisitById(visitId)
+
+	if visitBytes == nil {
+		return ErrEntityNotFound
+	}
+
+	visit := new(entities.Visit)
+
+	err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(visitBytes, visit)
+
+	if err != nil {
+		storage.errorLogger.Fatalln(err)
+	}
+
+	storage.visitIndexByLocationID.DeleteVisit(*visit.Location, visitId)
+	storage.visitIndexByUserID.DeleteVisit(*visit.User, visitId)
+	storage.visitStatsIndexByUser.DeleteVisit(visit)
+	storage.visitIndexByID.DeleteVisit(visitId)
+
+	return nil
+}
+
 func (storage *Storage) IsEmailExist(email string) bool {
 
 	return storage.userIndexByEmail.IsEmailExist(email)
 }
 
-//TODO need to refactor: logic mix
+// TODO need to refactor: logic mix
 func (storage *Storage) GetVisitedPlacesByUser(visitFilter *VisitsFilter) *entities.VisitedPlaceCollection {
 
+	profile := visitFilter.Profile
+
+	endLookup := profile.Phase("lookup")
+
+	profile.UseIndex("user_index_by_id")
+
 	userBytes := storage.GetUserById(*visitFilter.UserId)
 
 	if userBytes == nil {
+		endLookup()
 		return nil
 	}
 
+	var user *entities.User
+
+	//the user is only needed by a filter expression
+	if visitFilter.Expression != nil {
+
+		user = new(entities.User)
+
+		err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(userBytes, user)
+
+		if err != nil {
+			storage.errorLogger.Fatalln(err)
+		}
+
+		profile.Decode()
+	}
+
+	profile.UseIndex("visit_index_by_user_id")
+
 	visitsIds := storage.visitIndexByUserID.GetVisits(*visitFilter.UserId)
 
+	endLookup()
+
 	visitedPlaceCollection := &entities.VisitedPlaceCollection{VisitedPlaces: make([]*entities.VisitedPlace, 0)}
 
 	if len(visitsIds) == 0 {
 		return visitedPlaceCollection
 	}
 
+	endScan := profile.Phase("scan")
+
+	profile.UseIndex("visit_index_by_id")
+	profile.UseIndex("location_index_by_id")
+
 	for _, visitId := range visitsIds {
 
+		profile.Scan()
+
 		visit := new(entities.Visit)
 
 		visitBytes := storage.GetVisitById(visitId)
 
+		if visitBytes == nil {
+			continue
+		}
+
 		err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(visitBytes, visit)
 
 		if err != nil {
 			storage.errorLogger.Fatalln(err)
 		}
 
+		profile.Decode()
+
 		location := new(entities.Location)
 
 		locationBytes := storage.GetLocationById(*visit.Location)
 
+		//dangling reference: orphaned by a delete or loaded without a strict reference check
+		if locationBytes == nil {
+			continue
+		}
+
 		err = jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(locationBytes, location)
 
 		if err != nil {
 			storage.errorLogger.Fatalln(err)
 		}
 
-		if
-		!visitFilter.CheckFromDate(*visit.VisitedAt) ||
-			!visitFilter.CheckToDate(*visit.VisitedAt) ||
-			!visitFilter.CheckToDistance(*location.Distance) ||
-			!visitFilter.CheckCountry(*location.Country) {
+		profile.Decode()
+
+		if !visitFilter.Match(ScopeUserVisits, &FilterSubject{Visit: visit, User: user, Location: location}) {
 			continue
 		}
 
-		visitedPlace := &entities.VisitedPlace{VisitedAt: *visit.VisitedAt, Mark: *visit.Mark, Place: *location.Place}
+		profile.Match()
+
+		visitedPlace := &entities.VisitedPlace{VisitedAt: *visit.VisitedAt, Mark: *visit.Mark, Place: *location.Place, Distance: *location.Distance, Location: *location.Id, Country: *location.Country, City: *location.City}
 
 		visitedPlaceCollection.VisitedPlaces = append(visitedPlaceCollection.VisitedPlaces, visitedPlace)
 	}
 
-	sort.Sort(visitedPlaceCollection)
+	endScan()
+
+	endSort := profile.Phase("sort")
+
+	sort.Stable(visitedPlaceCollection)
+
+	endSort()
 
 	return visitedPlaceCollection
 }
@@ -290,3 +640,117 @@ func (storage *Storage) GetVisitsByLocationId(locationId uint) []uint {
 
 	return storage.visitIndexByLocationID.GetVisits(locationId)
 }
+
+// GetVisitsOfLocation returns the visits of the location which pass the filter, nil if there is no such location
+func (storage *Storage) GetVisitsOfLocation(visitFilter *VisitsFilter) *entities.VisitCollection {
+
+	locationVisits := storage.GetLocationVisits(visitFilter)
+
+	if locationVisits == nil {
+		return nil
+	}
+
+	visitCollection := &entities.VisitCollection{Visits: make([]*entities.Visit, 0, len(locationVisits))}
+
+	for _, locationVisit := range locationVisits {
+		visitCollection.Visits = append(visitCollection.Visits, locationVisit.Visit)
+	}
+
+	return visitCollection
+}
+
+// GetLocationVisits returns the filtered visits of a location together with their visitors, nil if the location does not exist
+func (storage *Storage) GetLocationVisits(visitFilter *VisitsFilter) []*entities.LocationVisit {
+
+	profile := visitFilter.Profile
+
+	endLookup := profile.Phase("lookup")
+
+	profile.UseIndex("location_index_by_id")
+
+	locationBytes := storage.GetLocationById(*visitFilter.LocationId)
+
+	if locationBytes == nil {
+		endLookup()
+		return nil
+	}
+
+	var location *entities.Location
+
+	//the location is only needed by a filter expression
+	if visitFilter.Expression != nil {
+
+		location = new(entities.Location)
+
+		err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(locationBytes, location)
+
+		if err != nil {
+			storage.errorLogger.Fatalln(err)
+		}
+
+		profile.Decode()
+	}
+
+	profile.UseIndex("visit_index_by_location_id")
+
+	visitsIds := storage.visitIndexByLocationID.GetVisits(*visitFilter.LocationId)
+
+	endLookup()
+
+	endScan := profile.Phase("scan")
+
+	profile.UseIndex("visit_index_by_id")
+	profile.UseIndex("user_index_by_id")
+
+	locationVisits := make([]*entities.LocationVisit, 0)
+
+	for _, visitId := range visitsIds {
+
+		profile.Scan()
+
+		visitBytes := storage.GetVisitById(visitId)
+
+		if visitBytes == nil {
+			continue
+		}
+
+		visit := new(entities.Visit)
+
+		err := jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(visitBytes, visit)
+
+		if err != nil {
+			storage.errorLogger.Fatalln(err)
+		}
+
+		profile.Decode()
+
+		userBytes := storage.GetUserById(*visit.User)
+
+		//dangling reference: orphaned by a delete or loaded without a strict reference check
+		if userBytes == nil {
+			continue
+		}
+
+		user := new(entities.User)
+
+		err = jsoniter.ConfigCompatibleWithStandardLibrary.Unmarshal(userBytes, user)
+
+		if err != nil {
+			storage.errorLogger.Fatalln(err)
+		}
+
+		profile.Decode()
+
+		if !visitFilter.Match(ScopeLocationVisits, &FilterSubject{Visit: visit, User: user, Location: location}) {
+			continue
+		}
+
+		profile.Match()
+
+		locationVisits = append(locationVisits, &entities.LocationVisit{Visit: visit, User: user})
+	}
+
+	endScan()
+
+	return locationVisits
+}